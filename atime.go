@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+)
+
+// openRead opens a file or directory on the source for reading. With
+// PreserveAtime it's opened with O_NOATIME, which only the owner and root may
+// use. Where that isn't possible, the times are returned so closeRead can put
+// the access time back.
+func (s *Server) openRead(path string) (*os.File, *FileInfo, error) {
+	if !s.PreserveAtime {
+		f, err := s.root.OpenFile(path, os.O_RDONLY, 0)
+		return f, nil, err
+	}
+	if noatimeFlag != 0 {
+		f, err := s.root.OpenFile(path, os.O_RDONLY|noatimeFlag, 0)
+		if !errors.Is(err, fs.ErrPermission) {
+			return f, nil, err
+		}
+	}
+	f, err := s.root.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return f, nil, nil
+	}
+	times := FileInfo{Name: f.Name()}
+	if times.extractNativeInfo(info) != nil {
+		return f, nil, nil
+	}
+	return f, &times, nil
+}
+
+// closeRead closes a file from openRead, and restores its access time if it
+// was opened without O_NOATIME
+func closeRead(f *os.File, times *FileInfo) error {
+	if times != nil {
+		if err := restoreAtime(f, *times); err != nil {
+			logger.Debug().Msgf("Can't restore access time of %s: %v", times.Name, err)
+		}
+	}
+	return f.Close()
+}
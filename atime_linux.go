@@ -0,0 +1,24 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"os"
+	"strconv"
+
+	unix "golang.org/x/sys/unix"
+)
+
+// noatimeFlag opens files without updating their access time
+const noatimeFlag = unix.O_NOATIME
+
+// restoreAtime sets the access time of the open file back to what's in
+// times, leaving the modification time alone
+func restoreAtime(f *os.File, times FileInfo) error {
+	path := f.Name()
+	if procAvailable() {
+		path = "/proc/self/fd/" + strconv.Itoa(int(f.Fd()))
+	}
+	return unix.UtimesNanoAt(unix.AT_FDCWD, path, []unix.Timespec{unix.Timespec(times.Atim), {Nsec: unix.UTIME_OMIT}}, 0)
+}
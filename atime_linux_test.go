@@ -0,0 +1,116 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	unix "golang.org/x/sys/unix"
+)
+
+var (
+	oldAtime = time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+	oldMtime = time.Date(2002, 1, 1, 0, 0, 0, 0, time.UTC)
+)
+
+// strictatimeFile makes a file on a tmpfs mounted with strictatime, so every
+// read updates the access time, with both times set in the past
+func strictatimeFile(t *testing.T) (dir, name string) {
+	dir = t.TempDir()
+	if err := unix.Mount("tmpfs", dir, "tmpfs", unix.MS_STRICTATIME, "size=1m"); err != nil {
+		t.Skipf("can't mount a tmpfs with strictatime: %v", err)
+	}
+	t.Cleanup(func() { unix.Unmount(dir, unix.MNT_DETACH) })
+	name = "file"
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte("some content to read"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, oldAtime, oldMtime); err != nil {
+		t.Fatal(err)
+	}
+	return dir, name
+}
+
+func fileTimes(t *testing.T, path string) (atime, mtime time.Time) {
+	t.Helper()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat := info.Sys().(*syscall.Stat_t)
+	return time.Unix(stat.Atim.Unix()), time.Unix(stat.Mtim.Unix())
+}
+
+func TestPreserveAtime(t *testing.T) {
+	for _, preserve := range []bool{false, true} {
+		dir, name := strictatimeFile(t)
+		s := NewServer(dir, false)
+		s.PreserveAtime = preserve
+		c := NewConnection(s)
+
+		var reply OpenReply
+		if err := c.Open(name, &reply); err != nil {
+			t.Fatal(err)
+		}
+		var data []byte
+		if err := c.GetChunk(GetChunkArgs{Handle: reply.Handle, Size: uint64(reply.Size)}, &data); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Close(reply.Handle, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		atime, mtime := fileTimes(t, filepath.Join(dir, name))
+		if preserve && !atime.Equal(oldAtime) {
+			t.Errorf("access time changed to %v when preserving it", atime)
+		}
+		if !preserve && atime.Equal(oldAtime) {
+			t.Error("access time didn't change when reading without preserving it, is strictatime working?")
+		}
+		if !mtime.Equal(oldMtime) {
+			t.Errorf("modification time changed to %v by reading", mtime)
+		}
+	}
+}
+
+func TestRestoreAtime(t *testing.T) {
+	// the fallback when O_NOATIME isn't allowed, where the access time is put
+	// back after reading
+	dir, name := strictatimeFile(t)
+	path := filepath.Join(dir, name)
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	times := FileInfo{Name: path}
+	if err := times.extractNativeInfo(info); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Read(make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+
+	// a write while reading must keep its modification time
+	if err := os.WriteFile(path, []byte("changed while reading"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, written := fileTimes(t, path)
+
+	if err := closeRead(f, &times); err != nil {
+		t.Fatal(err)
+	}
+	atime, mtime := fileTimes(t, path)
+	if !atime.Equal(oldAtime) {
+		t.Errorf("access time is %v, expected it restored to %v", atime, oldAtime)
+	}
+	if !mtime.Equal(written) {
+		t.Errorf("modification time is %v, expected the write at %v to be kept", mtime, written)
+	}
+}
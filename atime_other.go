@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "os"
+
+// noatimeFlag is zero where there's no O_NOATIME, so access times are
+// restored after reading instead
+const noatimeFlag = 0
+
+// restoreAtime sets the access time of the file back to what's in times. The
+// modification time is set along with it, so a write during the read is lost.
+func restoreAtime(f *os.File, times FileInfo) error {
+	return times.SetTimestamps(times)
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// how much unused bandwidth can be saved up for a burst
+const bandwidthBurst = 100 * time.Millisecond
+
+// how often the schedule file is checked for changes and the limit updated
+const bandwidthScheduleInterval = 10 * time.Second
+
+// BandwidthLimiter limits the bytes per second sent and received over all
+// connections, each direction on its own. A nil BandwidthLimiter or a limit of
+// zero doesn't limit anything.
+type BandwidthLimiter struct {
+	limit atomic.Int64
+
+	read, write tokenBucket
+}
+
+func NewBandwidthLimiter(limit int64) *BandwidthLimiter {
+	bl := &BandwidthLimiter{}
+	bl.limit.Store(limit)
+	return bl
+}
+
+func (bl *BandwidthLimiter) SetLimit(limit int64) {
+	if bl.limit.Swap(limit) != limit {
+		logger.Info().Msgf("Bandwidth limit is now %v", formatBandwidth(limit))
+	}
+}
+
+func (bl *BandwidthLimiter) Limit() int64 {
+	return bl.limit.Load()
+}
+
+// WaitRead holds up the reader after receiving n bytes, which makes TCP slow
+// down the other side
+func (bl *BandwidthLimiter) WaitRead(n int) {
+	if bl == nil {
+		return
+	}
+	bl.read.wait(n, bl.limit.Load())
+}
+
+// WaitWrite holds up the writer before sending n bytes
+func (bl *BandwidthLimiter) WaitWrite(n int) {
+	if bl == nil {
+		return
+	}
+	bl.write.wait(n, bl.limit.Load())
+}
+
+type tokenBucket struct {
+	lock sync.Mutex
+	next time.Time // when the bytes passed so far are paid for
+}
+
+func (tb *tokenBucket) wait(n int, limit int64) {
+	if limit <= 0 || n <= 0 {
+		return
+	}
+	tb.lock.Lock()
+	now := time.Now()
+	if earliest := now.Add(-bandwidthBurst); tb.next.Before(earliest) {
+		tb.next = earliest
+	}
+	tb.next = tb.next.Add(time.Duration(float64(n) / float64(limit) * float64(time.Second)))
+	wait := tb.next.Sub(now)
+	tb.lock.Unlock()
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// ParseBandwidth reads a limit in bytes per second like 500KB or 10MiB, where
+// 0 is no limit
+func ParseBandwidth(s string) (int64, error) {
+	s = strings.TrimSuffix(strings.TrimSpace(s), "/s")
+	limit, err := humanize.ParseBytes(s)
+	return int64(limit), err
+}
+
+func formatBandwidth(limit int64) string {
+	if limit <= 0 {
+		return "unlimited"
+	}
+	return humanize.Bytes(uint64(limit)) + "/s"
+}
+
+// A bandwidth schedule has a line for each time of day the limit changes,
+// and the limit of the last entry carries on past midnight. If several lines
+// have the same time, the last of them wins:
+//
+//	# office hours
+//	08:00 2MB
+//	18:00 0
+type bandwidthScheduleEntry struct {
+	minute int // of the day
+	limit  int64
+}
+
+func ParseBandwidthSchedule(r io.Reader) ([]bandwidthScheduleEntry, error) {
+	var schedule []bandwidthScheduleEntry
+	scanner := bufio.NewScanner(r)
+	var line int
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("line %v: expected time and limit", line)
+		}
+		clock, limitstring := fields[0], strings.Join(fields[1:], " ")
+		at, err := time.Parse("15:04", clock)
+		if err != nil {
+			return nil, fmt.Errorf("line %v: invalid time %v", line, clock)
+		}
+		limit, err := ParseBandwidth(limitstring)
+		if err != nil {
+			return nil, fmt.Errorf("line %v: invalid limit %v", line, limitstring)
+		}
+		schedule = append(schedule, bandwidthScheduleEntry{
+			minute: at.Hour()*60 + at.Minute(),
+			limit:  limit,
+		})
+	}
+	slices.SortStableFunc(schedule, func(a, b bandwidthScheduleEntry) int {
+		return a.minute - b.minute
+	})
+	return schedule, scanner.Err()
+}
+
+// bandwidthAt returns the limit in the schedule at the given time, or ok false
+// if the schedule is empty
+func bandwidthAt(schedule []bandwidthScheduleEntry, t time.Time) (limit int64, ok bool) {
+	if len(schedule) == 0 {
+		return 0, false
+	}
+	minute := t.Hour()*60 + t.Minute()
+	// before the first entry of the day, the last one from yesterday applies
+	limit = schedule[len(schedule)-1].limit
+	for _, entry := range schedule {
+		if entry.minute > minute {
+			break
+		}
+		limit = entry.limit
+	}
+	return limit, true
+}
+
+// RunSchedule changes the limit according to a schedule file, which is read
+// again when it changes, so limits can be adjusted while running. If the
+// schedule is empty the limit we started with is used.
+func (bl *BandwidthLimiter) RunSchedule(filename string) error {
+	fallback := bl.Limit()
+	var schedule []bandwidthScheduleEntry
+	var loaded time.Time
+
+	load := func() error {
+		info, err := os.Stat(filename)
+		if err != nil {
+			return err
+		}
+		if info.ModTime().Equal(loaded) {
+			return nil
+		}
+		f, err := os.Open(filename)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		newschedule, err := ParseBandwidthSchedule(f)
+		if err != nil {
+			return fmt.Errorf("%v: %v", filename, err)
+		}
+		if !loaded.IsZero() {
+			logger.Info().Msgf("Reloaded bandwidth schedule %v", filename)
+		}
+		schedule = newschedule
+		loaded = info.ModTime()
+		return nil
+	}
+	apply := func() {
+		if limit, ok := bandwidthAt(schedule, time.Now()); ok {
+			bl.SetLimit(limit)
+		} else {
+			bl.SetLimit(fallback)
+		}
+	}
+
+	err := load()
+	if err != nil {
+		return err
+	}
+	apply()
+
+	go func() {
+		for range time.Tick(bandwidthScheduleInterval) {
+			err := load()
+			if err != nil {
+				logger.Error().Msgf("Error reading bandwidth schedule, keeping the old one: %v", err)
+			}
+			apply()
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseBandwidth(t *testing.T) {
+	for _, test := range []struct {
+		in    string
+		limit int64
+		fails bool
+	}{
+		{in: "0", limit: 0},
+		{in: "500", limit: 500},
+		{in: "500KB", limit: 500 * 1000},
+		{in: "10MiB", limit: 10 * 1024 * 1024},
+		{in: "10MB/s", limit: 10 * 1000 * 1000},
+		{in: " 1 GB ", limit: 1000 * 1000 * 1000},
+		{in: "1.5kb", limit: 1500},
+		{in: "fast", fails: true},
+		{in: "", fails: true},
+	} {
+		limit, err := ParseBandwidth(test.in)
+		if test.fails {
+			if err == nil {
+				t.Errorf("%q was accepted as %v", test.in, limit)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", test.in, err)
+		} else if limit != test.limit {
+			t.Errorf("%q is %v, expected %v", test.in, limit, test.limit)
+		}
+	}
+}
+
+func TestParseBandwidthSchedule(t *testing.T) {
+	schedule, err := ParseBandwidthSchedule(strings.NewReader(`
+# office hours
+18:00 0
+08:00 2MB
+
+  12:30   500 KB
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []bandwidthScheduleEntry{
+		{minute: 8 * 60, limit: 2000000},
+		{minute: 12*60 + 30, limit: 500000},
+		{minute: 18 * 60, limit: 0},
+	}
+	if len(schedule) != len(expected) {
+		t.Fatalf("schedule is %+v, expected %+v", schedule, expected)
+	}
+	for i := range expected {
+		if schedule[i] != expected[i] {
+			t.Errorf("entry %v is %+v, expected %+v", i, schedule[i], expected[i])
+		}
+	}
+
+	for _, bad := range []string{
+		"08:00",
+		"8am 1MB",
+		"25:00 1MB",
+		"08:00 lots",
+	} {
+		if _, err := ParseBandwidthSchedule(strings.NewReader(bad)); err == nil {
+			t.Errorf("%q was accepted", bad)
+		}
+	}
+}
+
+func TestBandwidthAt(t *testing.T) {
+	at := func(clock string) time.Time {
+		t, _ := time.Parse("15:04", clock)
+		return t
+	}
+	for _, test := range []struct {
+		name     string
+		schedule string
+		checks   map[string]int64
+	}{
+		{"day and night", "08:00 2MB\n18:00 0", map[string]int64{
+			"00:00": 0, // the evening entry carries on past midnight
+			"07:59": 0,
+			"08:00": 2000000,
+			"17:59": 2000000,
+			"18:00": 0,
+			"23:59": 0,
+		}},
+		{"night limit wraps around midnight", "22:00 1MB\n06:00 0", map[string]int64{
+			"21:59": 0,
+			"22:00": 1000000,
+			"23:59": 1000000,
+			"00:00": 1000000,
+			"05:59": 1000000,
+			"06:00": 0,
+		}},
+		{"overlapping entries, the last line wins", "08:00 1MB\n08:00 2MB\n12:00 3MB", map[string]int64{
+			"07:00": 3000000,
+			"08:00": 2000000,
+			"11:59": 2000000,
+			"12:00": 3000000,
+		}},
+		{"single entry", "12:00 1MB", map[string]int64{
+			"00:00": 1000000,
+			"12:00": 1000000,
+			"23:59": 1000000,
+		}},
+	} {
+		schedule, err := ParseBandwidthSchedule(strings.NewReader(test.schedule))
+		if err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+		for clock, expected := range test.checks {
+			limit, ok := bandwidthAt(schedule, at(clock))
+			if !ok || limit != expected {
+				t.Errorf("%v: limit at %v is %v, expected %v", test.name, clock, limit, expected)
+			}
+		}
+	}
+
+	if _, ok := bandwidthAt(nil, time.Now()); ok {
+		t.Error("empty schedule has a limit")
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		limit    int64
+		chunks   int
+		size     int
+		min, max time.Duration
+	}{
+		{"unlimited", 0, 100, 1000000, 0, 50 * time.Millisecond},
+		// the first 100ms worth is a burst that's let through straight away
+		{"limited", 1000000, 30, 10000, 150 * time.Millisecond, time.Second},
+		{"burst only", 1000000, 10, 10000, 0, 50 * time.Millisecond},
+	} {
+		var tb tokenBucket
+		start := time.Now()
+		for i := 0; i < test.chunks; i++ {
+			tb.wait(test.size, test.limit)
+		}
+		if took := time.Since(start); took < test.min || took > test.max {
+			t.Errorf("%v: %v chunks of %v bytes took %v, expected between %v and %v", test.name, test.chunks, test.size, took, test.min, test.max)
+		}
+	}
+
+	// a nil limiter doesn't limit anything
+	var bl *BandwidthLimiter
+	bl.WaitRead(1 << 30)
+	bl.WaitWrite(1 << 30)
+}
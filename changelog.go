@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+type ChangeAction string
+
+const (
+	ChangeCreated        ChangeAction = "created"
+	ChangeContentUpdated ChangeAction = "content-updated"
+	ChangeMetadataOnly   ChangeAction = "metadata-only"
+	ChangeHardlinked     ChangeAction = "hardlinked"
+	ChangeDeleted        ChangeAction = "deleted"
+	ChangeTypeChanged    ChangeAction = "type-changed"
+	ChangeSkipped        ChangeAction = "skipped"
+	ChangeError          ChangeAction = "error"
+	ChangeVerified       ChangeAction = "verified"
+)
+
+// ChangeEntry is one line in the changelog
+type ChangeEntry struct {
+	Time        time.Time    `json:"time"`
+	Path        string       `json:"path"`
+	Action      ChangeAction `json:"action"`
+	Bytes       uint64       `json:"bytes"`
+	Differences []string     `json:"differences,omitempty"`
+	Hash        string       `json:"hash,omitempty"` // algorithm:hex of the verified content
+	Error       string       `json:"error,omitempty"`
+	// birth time of the source entry, read with --inode-flags. Linux can't
+	// set it, so the copy gets a new one and this is where the original is kept.
+	Btime *time.Time `json:"btime,omitempty"`
+}
+
+// birthTime returns the birth time of an entry for the changelog, or nil if
+// it isn't known
+func birthTime(fi FileInfo) *time.Time {
+	if fi.Btime.Sec == 0 && fi.Btime.Nsec == 0 {
+		return nil
+	}
+	btime := time.Unix(fi.Btime.Unix()).UTC()
+	return &btime
+}
+
+// ChangeLog writes one JSON object per line for each entry that was changed,
+// skipped or failed. A nil ChangeLog discards everything.
+type ChangeLog struct {
+	lock    sync.Mutex
+	file    *os.File
+	writer  *bufio.Writer
+	encoder *json.Encoder
+}
+
+func NewChangeLog(filename string) (*ChangeLog, error) {
+	f, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriter(f)
+	return &ChangeLog{
+		file:    f,
+		writer:  w,
+		encoder: json.NewEncoder(w),
+	}, nil
+}
+
+func (cl *ChangeLog) Record(entry ChangeEntry) {
+	if cl == nil {
+		return
+	}
+	entry.Time = time.Now()
+	cl.lock.Lock()
+	err := cl.encoder.Encode(entry)
+	cl.lock.Unlock()
+	if err != nil {
+		logger.Error().Msgf("Error writing changelog entry for %s: %v", entry.Path, err)
+	}
+}
+
+func (cl *ChangeLog) RecordError(path string, err error) {
+	cl.Record(ChangeEntry{
+		Path:   path,
+		Action: ChangeError,
+		Error:  err.Error(),
+	})
+}
+
+func (cl *ChangeLog) Close() error {
+	if cl == nil {
+		return nil
+	}
+	cl.lock.Lock()
+	defer cl.lock.Unlock()
+	err := cl.writer.Flush()
+	if err != nil {
+		cl.file.Close()
+		return err
+	}
+	return cl.file.Close()
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"io"
 	"io/fs"
-	"net/rpc"
 	"os"
 	"path/filepath"
 	"strings"
@@ -10,10 +12,12 @@ import (
 	"sync/atomic"
 	"time"
 
-	"github.com/cespare/xxhash/v2"
 	"github.com/lkarlslund/gonk"
 )
 
+// how many block hashes are compared at a time when verifying a file
+const checksumBlocksPerRequest = 1024
+
 type inodeinfo struct {
 	dev, inode           uint64
 	localhardlinkpath    string
@@ -34,28 +38,59 @@ type dirinfo struct {
 	info         FileInfo
 	extraentries []string // files/folders that are local only, and should be deleted
 	remaining    int32
+	failed       bool // something in this subtree failed, so it's not complete
 }
 
 func (f dirinfo) Compare(f2 dirinfo) int {
 	return strings.Compare(f.name, f2.name)
 }
 
+// Client drives a sync from a Source to a Target. In the traversal code
+// "remote" is the source side and "local" is the target side, which is
+// literally true when pulling and the other way around when pushing.
 type Client struct {
-	BasePath string
-
 	AlwaysChecksum bool
 	SendACL        bool
 	Delete         bool
+	DeleteExcluded bool
+	InPlace        bool   // update changed files directly instead of replacing them
+	Delta          bool   // find moved blocks with a rolling checksum
+	VerifyHash     string // strong hash to check transferred files with, none if blank
+	Sparse         bool   // keep holes in sparse files instead of filling them in
+	SparseZeros    bool   // also turn blocks of zeros into holes
+
+	CompareOptions CompareOptions // optional attributes to compare and apply
+
+	Filter *Filter
+
+	Users, Groups *IDMapper // who owns entries on the target
+
+	DryRun     bool
+	DryRunList io.Writer // itemized list of changes that would be done
+
+	ChangeLog *ChangeLog
+
+	StateDir  string // where to keep the journal for resuming, none if blank
+	StateName string // identifies what is synced where, so syncs don't share journals
 
 	ParallelFile, ParallelDir int
+	ParallelStream            int // files streamed at the same time
+	StreamWindow              int // blocks in flight per streamed file
 	PreserveHardlinks         bool
 	BlockSize                 int
 
 	shutdown, done bool
 
+	source Source
+	target Target
+	dryrun *DryRunTarget
+
+	journal *Journal
+
 	dirWorkerWG, fileWorkerWG sync.WaitGroup
 
 	filequeue chan FileInfo
+	streams   chan struct{} // limits memory used for streaming
 	inodes    gonk.Gonk[inodeinfo]
 
 	dircache gonk.Gonk[dirinfo]
@@ -69,30 +104,52 @@ func NewClient() *Client {
 	c := &Client{
 		ParallelFile:      4096,
 		ParallelDir:       512,
+		ParallelStream:    64,
+		StreamWindow:      16,
 		PreserveHardlinks: true,
 		BlockSize:         128 * 1024,
+		Users:             NewIDMapper(false),
+		Groups:            NewIDMapper(true),
 	}
 
 	return c
 }
 
-func (c *Client) Run(client *rpc.Client) error {
+func (c *Client) Run(source Source, target Target) error {
 	// Start the process
 	var listfilesActive sync.WaitGroup
 
+	if c.DryRun {
+		c.dryrun = NewDryRunTarget(target, c.DryRunList)
+		target = c.dryrun
+	}
+	c.source = source
+	c.target = target
+
 	c.dirstack, c.dirqueueout, c.dirqueuein = NewStack[FileInfo](c.ParallelDir*2, 8)
 	c.filequeue = make(chan FileInfo, c.ParallelFile*16)
+	c.streams = make(chan struct{}, c.ParallelStream)
 
 	// Check that remote path exists and we can connect to server
-	var rootdirinfo FileInfo
-	err := client.Call("Server.Stat", "/", &rootdirinfo)
+	rootdirinfo, err := source.Stat("/")
 	if err != nil {
 		return err
 	}
+	c.mapOwner(&rootdirinfo)
+
+	if c.StateDir != "" && !c.DryRun {
+		c.journal, err = OpenJournal(c.StateDir, c.StateName, c.journalIdentity(rootdirinfo))
+		if err != nil {
+			return err
+		}
+		defer c.journal.Close()
+	}
+
 	logger.Debug().Msg("Queueing directory / from remote")
 	listfilesActive.Add(1)
 	c.dircache.Store(dirinfo{
 		name:      rootdirinfo.Name,
+		info:      rootdirinfo,
 		remaining: -1,
 	})
 	c.dirqueuein <- rootdirinfo
@@ -105,18 +162,47 @@ func (c *Client) Run(client *rpc.Client) error {
 			for item := range c.dirqueueout {
 				logger.Trace().Msgf("Processing directory queue item for %s", item.Name)
 
-				var filelistresponse FileListResponse
-				err := client.Call("Server.List", item.Name, &filelistresponse)
+				remotefiles, err := source.List(item.Name)
 
-				logger.Trace().Msgf("Listfiles response for directory %v: %v entries", item.Name, len(filelistresponse.Files))
+				logger.Trace().Msgf("Listfiles response for directory %v: %v entries", item.Name, len(remotefiles))
 				if err != nil {
 					logger.Error().Msgf("Error listing remote files in %v: %v", item.Name, err)
+					c.ChangeLog.RecordError(item.Name, err)
 					continue
 				}
 
+				for i := range remotefiles {
+					c.mapOwner(&remotefiles[i])
+				}
+
+				if c.CompareOptions.InodeFlags {
+					// nothing can be added to or removed from an immutable
+					// directory, the flags go back on when it's post processed
+					if localdirfi, err := target.Stat(item.Name); err == nil {
+						c.unlockInodeFlags(item.Name, &localdirfi)
+					}
+				}
+
+				if c.Filter.Len() > 0 {
+					included := remotefiles[:0]
+					for _, remotefi := range remotefiles {
+						if c.Filter.Excluded(remotefi.Name, remotefi.IsDir) {
+							logger.Debug().Msgf("Skipping excluded %s", remotefi.Name)
+							c.ChangeLog.Record(ChangeEntry{
+								Path:        remotefi.Name,
+								Action:      ChangeSkipped,
+								Differences: []string{"excluded"},
+							})
+							continue
+						}
+						included = append(included, remotefi)
+					}
+					remotefiles = included
+				}
+
 				var filecount int
 				remotenames := map[string]struct{}{}
-				for _, remotefi := range filelistresponse.Files {
+				for _, remotefi := range remotefiles {
 					remotenames[remotefi.Name] = struct{}{}
 					if !remotefi.IsDir {
 						filecount++
@@ -125,20 +211,28 @@ func (c *Client) Run(client *rpc.Client) error {
 
 				var extraentries []string
 				if c.Delete {
-					localentries, err := os.ReadDir(filepath.Join(c.BasePath, item.Name))
+					localentries, err := target.ReadDir(item.Name)
 					if err != nil {
 						logger.Error().Msgf("Error listing local files in %v: %v", item.Name, err)
 					} else {
 						for _, le := range localentries {
-							if _, found := remotenames[filepath.Join(item.Name, le.Name())]; !found {
-								extraentries = append(extraentries, le.Name())
+							if isTempSibling(le.Name) {
+								// replacements we're building, maybe resumed from an earlier run
+								continue
+							}
+							localname := filepath.Join(item.Name, le.Name)
+							if _, found := remotenames[localname]; !found {
+								if !c.DeleteExcluded && c.Filter.Excluded(localname, le.IsDir) {
+									continue
+								}
+								extraentries = append(extraentries, le.Name)
 							}
 						}
 					}
 				}
 
-				processentries := len(filelistresponse.Files)
-				logger.Trace().Msgf("Directory %v has %v remote entries (%v to delete local)", item.Name, len(filelistresponse.Files), len(extraentries))
+				processentries := len(remotefiles)
+				logger.Trace().Msgf("Directory %v has %v remote entries (%v to delete local)", item.Name, len(remotefiles), len(extraentries))
 
 				var directoryfound bool
 				c.dircache.AtomicMutate(dirinfo{
@@ -149,7 +243,7 @@ func (c *Client) Run(client *rpc.Client) error {
 					directoryfound = true
 				}, false)
 				if !directoryfound {
-					logger.Error().Msgf("directory %v not found in directory cache", filelistresponse.ParentDirectory)
+					logger.Error().Msgf("directory %v not found in directory cache", item.Name)
 				}
 
 				if processentries == 0 {
@@ -158,7 +252,7 @@ func (c *Client) Run(client *rpc.Client) error {
 					c.ProcessedItemInDir(item.Name)
 				} else {
 					// queue files first
-					for _, remotefi := range filelistresponse.Files {
+					for _, remotefi := range remotefiles {
 						if !remotefi.IsDir {
 							logger.Trace().Msgf("Queueing file %s", remotefi.Name)
 							c.filequeue <- remotefi
@@ -166,32 +260,44 @@ func (c *Client) Run(client *rpc.Client) error {
 					}
 
 					// queue directories second
-					for _, remotefi := range filelistresponse.Files {
+					for _, remotefi := range remotefiles {
 						if remotefi.IsDir {
-							localpath := filepath.Join(c.BasePath, remotefi.Name)
+							localpath := remotefi.Name
 							// logger.Trace().Msgf("Queueing directory %s", remotefi.Name)
 							// check if directory exists
-							localstat, err := PathToFileInfo(localpath)
+							localstat, err := target.Stat(localpath)
 							if os.IsNotExist(err) {
 								logger.Trace().Msgf("Creating directory %s", localpath)
-								err = os.MkdirAll(localpath, 0755)
+								err = target.Mkdir(localpath)
 								if err != nil {
 									logger.Error().Msgf("Error creating directory %v: %v", localpath, err)
+									c.ChangeLog.RecordError(localpath, err)
 									continue
 								}
+								c.ChangeLog.Record(ChangeEntry{
+									Path:   localpath,
+									Action: ChangeCreated,
+									Btime:  birthTime(remotefi),
+								})
 							} else if err == nil {
 								if !localstat.IsDir {
 									logger.Debug().Msgf("Existing target for directory %v is not a directory, deleteing it", localpath)
-									err = os.RemoveAll(localpath)
+									err = target.RemoveAll(localpath)
 									if err != nil {
 										logger.Error().Msgf("Error removing path %v: %v", localpath, err)
 									}
 									logger.Trace().Msgf("Creating directory %s", localpath)
-									err = os.MkdirAll(localpath, 0755)
+									err = target.Mkdir(localpath)
 									if err != nil {
 										logger.Error().Msgf("Error creating directory %v: %v", localpath, err)
+										c.ChangeLog.RecordError(localpath, err)
 										continue
 									}
+									c.ChangeLog.Record(ChangeEntry{
+										Path:        localpath,
+										Action:      ChangeTypeChanged,
+										Differences: []string{"type"},
+									})
 								}
 							} else {
 								logger.Warn().Msgf("Error getting information about path %v: %v", localpath, err)
@@ -221,14 +327,31 @@ func (c *Client) Run(client *rpc.Client) error {
 		go func() {
 			logger.Trace().Msg("Starting file worker")
 			for remotefi := range c.filequeue {
-				localpath := filepath.Join(c.BasePath, remotefi.Name)
+				localpath := remotefi.Name
 				logger.Trace().Msgf("Processing file %s", localpath)
 
+				// hardlinked files are always processed, as the others linking
+				// to them need to know where they are on the target
+				if !(c.PreserveHardlinks && remotefi.Nlink > 1) && c.journal.Completed(remotefi) {
+					logger.Debug().Msgf("Skipping file %v, it was completed in an earlier run", localpath)
+					c.ProcessedItemInDir(filepath.Dir(remotefi.Name))
+					p.Add(FilesProcessed, 1)
+					p.Add(BytesProcessed, uint64(remotefi.Size))
+					continue
+				}
+
 				create_file := false
 				copy_verify_file := false // do we need to copy it
 				apply_attributes := false // do we need to update owner etc.
 
-				localfi, err := PathToFileInfo(localpath)
+				// for the changelog
+				var differences []string
+				var transferred uint64
+				var transfererr error
+				var verifiedhash string
+				typechanged, hardlinked, contentchanged := false, false, false
+
+				localfi, err := target.Stat(localpath)
 				if err != nil {
 					if os.IsNotExist(err) {
 						logger.Debug().Msgf("File %s does not exist", localpath)
@@ -236,6 +359,7 @@ func (c *Client) Run(client *rpc.Client) error {
 						create_file = true
 					} else {
 						logger.Error().Msgf("Error getting fileinfo for local path %s: %v", localpath, err)
+						c.ChangeLog.RecordError(localpath, err)
 						continue
 					}
 				}
@@ -261,7 +385,9 @@ func (c *Client) Run(client *rpc.Client) error {
 							logger.Trace().Msgf("Added file %s to inode cache", remotefi.Name)
 							justaddedtoinodecache = true
 						}
-						if !create_file && atomic.CompareAndSwapUint64(&i.localinode, localfi.Inode, 0) {
+						// the first link seen on the source decides where the inode
+						// is on the target, so only set it while it's unknown
+						if justaddedtoinodecache && !create_file && atomic.CompareAndSwapUint64(&i.localinode, 0, localfi.Inode) {
 							logger.Trace().Msgf("Updated local inode for file %s", remotefi.Name)
 							atomic.SwapUint64(&i.localdev, localfi.Dev)
 						}
@@ -277,7 +403,7 @@ func (c *Client) Run(client *rpc.Client) error {
 						if ini.localinode == 0 {
 							// Find the local inode, we only need to do this once
 							for {
-								otherlocalfi, err := PathToFileInfo(ini.localhardlinkpath)
+								otherlocalfi, err := target.Stat(ini.localhardlinkpath)
 								if os.IsNotExist(err) {
 									logger.Warn().Msgf("Local hardlink path %s does not exist, delaying a bit", ini.localhardlinkpath)
 									time.Sleep(10 * time.Millisecond)
@@ -289,10 +415,11 @@ func (c *Client) Run(client *rpc.Client) error {
 										dev:   remotefi.Dev,
 										inode: remotefi.Inode,
 									}, func(i *inodeinfo) {
-										if atomic.CompareAndSwapUint64(&i.localinode, otherlocalfi.Inode, 0) {
+										// unless another link found it first
+										if atomic.CompareAndSwapUint64(&i.localinode, 0, otherlocalfi.Inode) {
 											atomic.SwapUint64(&i.localdev, otherlocalfi.Dev)
-											ini = *i
 										}
+										ini = *i
 									}, false)
 									break
 								}
@@ -301,54 +428,72 @@ func (c *Client) Run(client *rpc.Client) error {
 
 						if localfi.Inode != ini.localinode || localfi.Dev != ini.localdev {
 							logger.Debug().Msgf("Hardlink %s and %s have different inodes but should match, unlinking file", localpath, ini.localhardlinkpath)
-							err = os.Remove(localpath)
+							err = target.Remove(localpath)
 							if err != nil {
 								logger.Error().Msgf("Error unlinking %s: %v", localpath, err)
+								c.ChangeLog.RecordError(localpath, err)
 								continue
 							}
+							differences = append(differences, "hardlink")
 							create_file = true
 						}
 					}
 				}
 
-				if !create_file && localfi.Mode&os.ModeType != remotefi.Mode&os.ModeType {
+				var diff FileDiff
+				if !create_file {
+					diff = localfi.Compare(remotefi, c.CompareOptions)
+					if !diff.Equal() {
+						logger.Debug().Msgf("File %s differs in %v", localpath, strings.Join(diff.Differences(), ", "))
+					}
+					differences = append(differences, diff.Differences()...)
+				}
+
+				var unlocked bool
+				if !create_file && (!diff.Equal() || c.AlwaysChecksum) {
+					unlocked = c.unlockInodeFlags(localpath, &localfi)
+				}
+
+				// changed files are built next to the old one and renamed into
+				// place, unless that would break hardlinks
+				replace := !c.InPlace && !c.DryRun && !create_file &&
+					localfi.Mode.IsRegular() && remotefi.Mode.IsRegular() &&
+					localfi.Nlink <= 1 && !(c.PreserveHardlinks && remotefi.Nlink > 1)
+
+				if !create_file && diff.RequiresDelete() {
 					logger.Debug().Msgf("File %s is indicating type change from %v to %v, unlinking", localpath, localfi.Mode.String(), remotefi.Mode.String())
-					err = os.Remove(localpath)
+					err = target.Remove(localpath)
 					if err != nil {
 						logger.Error().Msgf("Error unlinking %s: %v", localpath, err)
+						c.ChangeLog.RecordError(localpath, err)
 						continue
 					}
 
+					typechanged = true
 					create_file = true
 				}
 
 				if !create_file { // still exists
-					if localfi.Size > remotefi.Size && remotefi.Mode&fs.ModeSymlink == 0 {
+					if diff.Size && localfi.Size > remotefi.Size && !(replace && remotefi.Size > 0) {
 						logger.Debug().Msgf("File %s is indicating size change from %v to %v, truncating", localpath, localfi.Size, remotefi.Size)
-						err = os.Truncate(localpath, int64(remotefi.Size))
+						err = target.Truncate(localpath, int64(remotefi.Size))
 						if err != nil {
 							logger.Error().Msgf("Error truncating %s to %v bytes to match remote: %v", localpath, remotefi.Size, err)
+							c.ChangeLog.RecordError(localpath, err)
 							continue
 						}
-						apply_attributes = true
+						contentchanged = true
 					}
-					if localfi.Mtim.Nano() != remotefi.Mtim.Nano() {
-						logger.Debug().Msgf("File %s is indicating time change from %v to %v, applying attribute changes", localpath, time.Unix(0, localfi.Mtim.Nano()), time.Unix(0, remotefi.Mtim.Nano()))
-						apply_attributes = true
-					}
-
-					if localfi.Mode.Perm() != remotefi.Mode.Perm() || localfi.Owner != remotefi.Owner || localfi.Group != remotefi.Group {
-						logger.Debug().Msgf("File %s is indicating permissions changes, applying attribute changes", localpath)
+					if diff.Metadata() {
 						apply_attributes = true
 					}
-
 				}
 
-				if create_file {
+				if create_file || unlocked {
 					apply_attributes = true
 				}
 
-				if remotefi.Size > 0 && remotefi.Mode&fs.ModeSymlink == 0 && (apply_attributes || c.AlwaysChecksum) {
+				if remotefi.Size > 0 && remotefi.Mode.IsRegular() && (create_file || diff.Content || c.AlwaysChecksum) {
 					logger.Debug().Msgf("Doing file content validation for %s", localpath)
 					copy_verify_file = true
 				}
@@ -363,7 +508,7 @@ func (c *Client) Run(client *rpc.Client) error {
 							logger.Debug().Msgf("Hardlinking %s to %s", localpath, ini.localhardlinkpath)
 							var retries int
 							for {
-								err = os.Link(ini.localhardlinkpath, localpath)
+								err = target.Link(ini.localhardlinkpath, localpath)
 								if err != nil {
 									if os.IsNotExist(err) {
 										retries++
@@ -378,8 +523,10 @@ func (c *Client) Run(client *rpc.Client) error {
 								break
 							}
 							if err != nil {
+								c.ChangeLog.RecordError(localpath, err)
 								continue
 							}
+							hardlinked = true
 							create_file = false
 							copy_verify_file = false
 							apply_attributes = true
@@ -400,12 +547,19 @@ func (c *Client) Run(client *rpc.Client) error {
 				}
 
 				if create_file {
-					err = localfi.Create(remotefi)
+					err = target.Create(localpath, remotefi)
 					if err == ErrNotSupportedByPlatform {
 						logger.Warn().Msgf("Skipping %s: %v", localpath, err)
+						c.ChangeLog.Record(ChangeEntry{
+							Path:        localpath,
+							Action:      ChangeSkipped,
+							Differences: []string{"unsupported"},
+							Error:       err.Error(),
+						})
 						continue
 					} else if err != nil {
 						logger.Error().Msgf("Error creating %s: %v", localpath, err)
+						c.ChangeLog.RecordError(localpath, err)
 						continue
 					}
 				}
@@ -413,100 +567,596 @@ func (c *Client) Run(client *rpc.Client) error {
 				if copy_verify_file {
 					// file exists but is different, copy it
 					logger.Debug().Msgf("Processing blocks for %s", remotefi.Name)
-					var existingsize int64
 
 					// Open file if we didn't create it earlier
-					localfile, err := os.OpenFile(localpath, os.O_RDWR, fs.FileMode(remotefi.Mode))
+					localfile, err := target.OpenFile(localpath, fs.FileMode(remotefi.Mode))
 					if err != nil {
 						logger.Error().Msgf("Error opening existing local file %s: %v", localpath, err)
+						c.ChangeLog.RecordError(localpath, err)
 						continue
 					}
-					fi, _ := os.Stat(localpath)
-					existingsize = fi.Size()
+					existingsize := localfile.Size()
+
+					// when replacing, the temporary file isn't created until we
+					// find the first difference, so verifying identical files is cheap
+					var tempfile TargetFile
+					var temppath string
+					// where the source file has data, all of it unless it's sparse
+					extents := []Extent{{Offset: 0, Size: remotefi.Size}}
+					startreplacing := func(upto int64) error {
+						temppath, err = target.CreateTemp(localpath)
+						if err != nil {
+							return err
+						}
+						tempfile, err = target.OpenFile(temppath, fs.FileMode(remotefi.Mode))
+						if err != nil {
+							target.Remove(temppath)
+							return err
+						}
+						// what's before upto is the same on both sides, holes stay holes
+						for _, extent := range extentsIn(extents, 0, upto) {
+							for o := extent.Offset; o < extent.Offset+extent.Size; o += int64(c.BlockSize) {
+								err = tempfile.CopyChunk(localfile, o, o, min(int64(c.BlockSize), extent.Offset+extent.Size-o))
+								if err != nil {
+									return err
+								}
+							}
+						}
+						return nil
+					}
 
-					err = client.Call("Server.Open", remotefi.Name, nil)
+					remotefile, err := source.Open(remotefi.Name)
 					if err != nil {
 						logger.Error().Msgf("Error opening remote file %s: %v", remotefi.Name, err)
 						logger.Error().Msgf("Item fileinfo: %+v", remotefi)
-						break
+						c.ChangeLog.RecordError(localpath, err)
+						localfile.Close()
+						continue
 					}
 
-					for i := int64(0); i < remotefi.Size; i += int64(c.BlockSize) {
-						if !transfersuccess {
-							break // we couldn't open the remote file
+					var start int64
+					if resume, resumetemp := c.journal.ResumeOffset(remotefi); resumetemp != "" {
+						// an earlier run was building a replacement, carry on with it
+						if resume > 0 && replace {
+							if tempfi, err := target.Stat(resumetemp); err == nil && tempfi.Mode.IsRegular() {
+								tempfile, err = target.OpenFile(resumetemp, fs.FileMode(remotefi.Mode))
+								if err == nil {
+									temppath = resumetemp
+									start = resume
+								}
+							}
+						}
+						if tempfile == nil {
+							target.Remove(resumetemp)
 						}
+					} else if resume > 0 && resume <= existingsize {
+						// the existing file was verified up to here
+						start = resume
+					}
+					if start > 0 {
+						logger.Info().Msgf("Resuming file %s at offset %v", localpath, start)
+					}
 
-						// Read the chunk
-						length := int64(c.BlockSize)
-						if i+length > remotefi.Size {
-							length = remotefi.Size - i
+					// set when parts of the file were left as holes, so the size
+					// has to be set at the end in case it ends with one
+					var leftholes bool
+
+					// makes a range of an existing file read as zeros
+					zerorange := func(f TargetFile, offset, size int64) error {
+						if f.PunchHole(offset, size) == nil {
+							return nil
+						}
+						for done := int64(0); done < size; done += int64(len(zeroBlock)) {
+							n := min(int64(len(zeroBlock)), size-done)
+							_, err := f.WriteAt(zeroBlock[:n], offset+done)
+							if err != nil {
+								return err
+							}
+						}
+						return nil
+					}
+
+					// writes a block, to the temporary file if we're replacing
+					writeblock := func(i int64, data []byte) error {
+						writefile := localfile
+						if replace {
+							if tempfile == nil {
+								err := startreplacing(i)
+								if err != nil {
+									logger.Error().Msgf("Error creating temporary file for %s: %v", localpath, err)
+									return err
+								}
+							}
+							writefile = tempfile
+						}
+						if c.SparseZeros && isZero(data) {
+							// new files have nothing there yet, so it's already a hole
+							if create_file || replace {
+								leftholes = true
+							} else if err := zerorange(writefile, i, int64(len(data))); err != nil {
+								logger.Error().Msgf("Error clearing local file %s chunk at %d: %v", localpath, i, err)
+								return err
+							}
+							transferred += uint64(len(data))
+							contentchanged = true
+							apply_attributes = true
+							return nil
+						}
+						n, err := writefile.WriteAt(data, i)
+						if err != nil {
+							logger.Error().Msgf("Error writing to local file %s chunk at %d: %v", localpath, i, err)
+							return err
 						}
-						chunkArgs := GetChunkArgs{
-							Path:   remotefi.Name,
-							Offset: uint64(i),
-							Size:   uint64(length),
+						if n != len(data) {
+							logger.Error().Msgf("Wrote %v bytes but expected to write %v", n, len(data))
+							return io.ErrShortWrite
 						}
-						if i+length <= existingsize {
-							var hash uint64
-							err = client.Call("Server.ChecksumChunk", chunkArgs, &hash)
+						transferred += uint64(n)
+						contentchanged = true
+						apply_attributes = true
+						return nil
+					}
+
+					// fetches chunks in the background and writes them as they
+					// arrive, calling beforewrite first for each of them
+					fetchchunks := func(chunks []GetChunkArgs, beforewrite func(chunk StreamChunk) error) error {
+						c.streams <- struct{}{}
+						defer func() {
+							<-c.streams
+						}()
+						stream := remotefile.Stream(chunks, c.StreamWindow)
+						defer stream.Close()
+						for {
+							chunk, ok := stream.Next()
+							if !ok {
+								return nil
+							}
+							if chunk.Err != nil {
+								logger.Error().Msgf("Error transferring file %s chunk at %d: %v", remotefi.Name, chunk.Offset, chunk.Err)
+								return chunk.Err
+							}
+							err := beforewrite(chunk)
 							if err != nil {
-								logger.Error().Msgf("Error getting remote checksum for file %s chunk at %d: %v", remotefi.Name, i, err)
-								transfersuccess = false
+								return err
 							}
-							localdata := make([]byte, length)
-							n, err := localfile.ReadAt(localdata, i)
+							err = writeblock(chunk.Offset, chunk.Data)
 							if err != nil {
-								logger.Error().Msgf("Error reading existing local file %s chunk at %d: %v", localpath, i, err)
+								return err
+							}
+						}
+					}
+
+					// delta transfers need somewhere else to build the file, as
+					// blocks are moved around
+					usedelta := c.Delta && !create_file && existingsize >= int64(c.BlockSize) && (replace || c.DryRun)
+
+					// nothing to compare with, or we trust size and mtime, so
+					// just send the whole thing without waiting for each block
+					streaming := !usedelta && (create_file || !c.AlwaysChecksum)
+
+					// holes in the source are left as holes instead of transferring zeros
+					sparse := c.Sparse && remotefi.Sparse && !usedelta
+					if sparse {
+						extents, err = remotefile.Extents()
+						if err != nil {
+							logger.Error().Msgf("Error finding data in remote file %s: %v", remotefi.Name, err)
+							transfererr = err
+							transfersuccess = false
+						} else {
+							leftholes = true
+						}
+					}
+
+					if usedelta {
+						logger.Debug().Msgf("Doing delta transfer of file %s", remotefi.Name)
+						drf, dryrun := localfile.(*dryRunFile)
+						sig, err := localfile.Signature(int64(c.BlockSize))
+						if err != nil {
+							logger.Error().Msgf("Error computing signature of local file %s: %v", localpath, err)
+							transfererr = err
+							transfersuccess = false
+						}
+
+						deltaArgs := DeltaArgs{
+							Signature: &sig,
+						}
+						for transfersuccess && deltaArgs.Offset < remotefi.Size {
+							deltaArgs.Size = int64(c.BlockSize) * deltaBlocksPerRequest
+							response, err := remotefile.Delta(deltaArgs)
+							if err == nil && response.End <= deltaArgs.Offset {
+								err = errors.New("delta made no progress")
+							}
+							if err != nil {
+								logger.Error().Msgf("Error getting delta for file %s at %d: %v", remotefi.Name, deltaArgs.Offset, err)
+								transfererr = err
 								transfersuccess = false
 								break
 							}
-							p.Add(ReadBytes, uint64(length))
-							if n == int(length) {
-								localhash := xxhash.Sum64(localdata)
-								logger.Trace().Msgf("Checksum for file %s chunk at %d is %X, remote is %X", remotefi.Name, i, localhash, hash)
-								if localhash == hash {
-									continue // Block matches
+							deltaArgs.Signature = nil // the source keeps it
+
+							out := deltaArgs.Offset
+							for _, op := range response.Ops {
+								if !op.Copy {
+									if dryrun {
+										drf.Skip(op.Size)
+										transferred += uint64(op.Size)
+										contentchanged = true
+										apply_attributes = true
+									} else {
+										err = writeblock(out, op.Data)
+									}
+								} else if op.CopyOffset != out || tempfile != nil {
+									// the temporary file is created when the first block moves
+									if tempfile == nil && !dryrun {
+										err = startreplacing(out)
+									}
+									contentchanged = true
+									apply_attributes = true
+									for done := int64(0); done < op.Size && !dryrun && err == nil; done += int64(c.BlockSize) {
+										length := min(int64(c.BlockSize), op.Size-done)
+										err = tempfile.CopyChunk(localfile, op.CopyOffset+done, out+done, length)
+									}
 								}
+								if err != nil {
+									logger.Error().Msgf("Error applying delta to file %s at %d: %v", localpath, out, err)
+									transfererr = err
+									transfersuccess = false
+									break
+								}
+								out += op.Size
 							}
+							deltaArgs.Offset = response.End
 						}
-
-						var data []byte
-						logger.Debug().Msgf("Transferring file %s chunk at %d", remotefi.Name, i)
-						err = client.Call("Server.GetChunk", chunkArgs, &data)
-						if err != nil {
-							logger.Error().Msgf("Error transferring file %s chunk at %d: %v", remotefi.Name, i, err)
-							transfersuccess = false
-							break
+					} else if drf, ok := localfile.(*dryRunFile); ok && streaming {
+						// no need to transfer data we're not going to write
+						drf.Skip(remotefi.Size - start)
+						transferred += uint64(remotefi.Size - start)
+						contentchanged = true
+						apply_attributes = true
+					} else if streaming {
+						logger.Debug().Msgf("Streaming file %s from offset %d", remotefi.Name, start)
+						if sparse && transfersuccess {
+							contentchanged = true
+							apply_attributes = true
+							if replace {
+								if tempfile == nil {
+									// start with an empty file, so holes don't get the old data
+									err = startreplacing(start)
+								}
+							} else if !create_file {
+								for _, hole := range holes(extents, start, min(existingsize, remotefi.Size)) {
+									err = zerorange(localfile, hole.Offset, hole.Size)
+									if err != nil {
+										break
+									}
+								}
+							}
+							if err != nil {
+								logger.Error().Msgf("Error making holes in local file %s: %v", localpath, err)
+								transfererr = err
+								transfersuccess = false
+							}
+						}
+						var chunks []GetChunkArgs
+						for _, extent := range extents {
+							for i := max(start, extent.Offset); i < extent.Offset+extent.Size; i += int64(c.BlockSize) {
+								chunks = append(chunks, GetChunkArgs{
+									Offset: uint64(i),
+									Size:   uint64(min(int64(c.BlockSize), extent.Offset+extent.Size-i)),
+								})
+							}
+						}
+						if !transfersuccess {
+							chunks = nil
 						}
-						n, err := localfile.WriteAt(data, i)
+						err = fetchchunks(chunks, func(chunk StreamChunk) error {
+							if chunk.Offset > start && chunk.Offset%journalProgressInterval < int64(c.BlockSize) {
+								// everything before this block is written
+								c.journal.FileProgress(remotefi, chunk.Offset, temppath)
+							}
+							return nil
+						})
 						if err != nil {
-							logger.Error().Msgf("Error writing to local file %s chunk at %d: %v", localpath, i, err)
+							transfererr = err
 							transfersuccess = false
-							break
 						}
-						if n != int(length) {
-							logger.Error().Msgf("Wrote %v bytes but expected to write %v", n, length)
+					} else {
+						// compare block hashes in batches, and only fetch the blocks that differ
+						blocksize := int64(c.BlockSize)
+						comparable := remotefi.Size
+						if existingsize < remotefi.Size {
+							comparable = existingsize / blocksize * blocksize
+						}
+						batchsize := blocksize * checksumBlocksPerRequest
+						for batch := start; transfersuccess && batch < remotefi.Size; batch += batchsize {
+							batchend := min(batch+batchsize, remotefi.Size)
+
+							var remotehashes, localhashes []uint64
+							if batch < comparable {
+								size := min(batchend, comparable) - batch
+								if batch == 0 && size == remotefi.Size {
+									remotehashes, err = remotefile.ChecksumFile(blocksize)
+								} else {
+									remotehashes, err = remotefile.ChecksumRange(batch, size, blocksize)
+								}
+								if err != nil {
+									logger.Error().Msgf("Error getting remote checksums for file %s at %d: %v", remotefi.Name, batch, err)
+									transfererr = err
+									transfersuccess = false
+									break
+								}
+								localhashes, err = localfile.ChecksumRange(batch, size, blocksize)
+								if err != nil {
+									logger.Error().Msgf("Error reading existing local file %s at %d: %v", localpath, batch, err)
+									transfererr = err
+									transfersuccess = false
+									break
+								}
+							}
+
+							matches := func(i int64) bool {
+								block := int((i - batch) / blocksize)
+								return block < len(remotehashes) && block < len(localhashes) && remotehashes[block] == localhashes[block]
+							}
+							batchdata := extentsIn(extents, batch, batchend)
+
+							// only the data in differing blocks is fetched
+							var chunks []GetChunkArgs
+							var differing int
+							firstdiffering := batchend
+							for i := batch; i < batchend; i += blocksize {
+								if matches(i) {
+									continue
+								}
+								differing++
+								firstdiffering = min(firstdiffering, i)
+								for _, data := range extentsIn(batchdata, i, min(i+blocksize, batchend)) {
+									chunks = append(chunks, GetChunkArgs{
+										Offset: uint64(data.Offset),
+										Size:   uint64(data.Size),
+									})
+								}
+							}
+							logger.Trace().Msgf("File %s has %v differing blocks between %d and %d", remotefi.Name, differing, batch, batchend)
+
+							// where the source has holes, old data in differing blocks has to
+							// go, and the zeros in matching blocks can be punched out
+							var clear, punch []Extent
+							if sparse {
+								for _, hole := range holes(batchdata, batch, min(batchend, existingsize)) {
+									for o := hole.Offset; o < hole.Offset+hole.Size; {
+										end := min(batch+((o-batch)/blocksize+1)*blocksize, hole.Offset+hole.Size)
+										if matches(o) {
+											punch = addExtent(punch, Extent{Offset: o, Size: end - o})
+										} else {
+											clear = addExtent(clear, Extent{Offset: o, Size: end - o})
+										}
+										o = end
+									}
+								}
+							}
+							if differing > 0 {
+								// even if it's only holes, which aren't fetched
+								contentchanged = true
+								apply_attributes = true
+							}
+
+							// unchanged blocks only need copying if we're building a new
+							// file, and holes are left out
+							copied := batch
+							copyunchanged := func(upto int64) error {
+								if tempfile != nil {
+									for _, data := range extentsIn(batchdata, copied, upto) {
+										for o := data.Offset; o < data.Offset+data.Size; o += blocksize {
+											length := min(blocksize, data.Offset+data.Size-o)
+											err := tempfile.CopyChunk(localfile, o, o, length)
+											if err != nil {
+												logger.Error().Msgf("Error copying unchanged chunk at %d to temporary file for %s: %v", o, localpath, err)
+												return err
+											}
+										}
+									}
+								}
+								copied = upto
+								return nil
+							}
+
+							if drf, ok := localfile.(*dryRunFile); ok {
+								// no need to transfer data we're not going to write
+								for _, chunk := range chunks {
+									drf.Skip(int64(chunk.Size))
+									transferred += chunk.Size
+									contentchanged = true
+									apply_attributes = true
+								}
+								for _, hole := range clear {
+									drf.Skip(hole.Size)
+								}
+							} else {
+								if replace && tempfile == nil && differing > 0 {
+									// a hole may be all that differs, so nothing would create it
+									err = startreplacing(firstdiffering)
+									copied = firstdiffering
+								} else if !replace {
+									for _, hole := range clear {
+										err = zerorange(localfile, hole.Offset, hole.Size)
+										if err != nil {
+											break
+										}
+									}
+								}
+								if err != nil {
+									logger.Error().Msgf("Error making holes in local file %s: %v", localpath, err)
+									transfererr = err
+									transfersuccess = false
+									break
+								}
+								if tempfile == nil {
+									// the content is the same, it just frees the space
+									for _, hole := range punch {
+										localfile.PunchHole(hole.Offset, hole.Size)
+									}
+								}
+
+								err = fetchchunks(chunks, func(chunk StreamChunk) error {
+									err := copyunchanged(chunk.Offset)
+									copied = chunk.Offset + int64(len(chunk.Data))
+									return err
+								})
+								if err == nil {
+									err = copyunchanged(batchend)
+								}
+								if err != nil {
+									transfererr = err
+									transfersuccess = false
+									break
+								}
+							}
+
+							if batchend < remotefi.Size && batch/journalProgressInterval != batchend/journalProgressInterval {
+								// everything before this is verified, or copied to
+								// the replacement if there is one
+								c.journal.FileProgress(remotefi, batchend, temppath)
+							}
+						}
+					}
+					if leftholes && transfersuccess && contentchanged && !c.DryRun {
+						// nothing was written to a hole at the end
+						sizepath := localpath
+						if tempfile != nil {
+							sizepath = temppath
+						}
+						err = target.Truncate(sizepath, remotefi.Size)
+						if err != nil {
+							logger.Error().Msgf("Error setting size of %s to %v bytes: %v", localpath, remotefi.Size, err)
+							transfererr = err
 							transfersuccess = false
-							break
 						}
-						p.Add(WrittenBytes, uint64(length))
-						apply_attributes = true
 					}
-					err = client.Call("Server.Close", remotefi.Name, nil)
+					err = remotefile.Close()
 					if err != nil {
 						logger.Error().Msgf("Error closing remote file %s: %v", remotefi.Name, err)
 					}
+					if tempfile != nil && transfersuccess {
+						err = tempfile.Sync()
+						if err != nil {
+							logger.Error().Msgf("Error syncing temporary file for %s: %v", localpath, err)
+							transfererr = err
+							transfersuccess = false
+						}
+					}
+					if tempfile != nil {
+						tempfile.Close()
+					}
 					localfile.Close()
+
+					// the strong hash is compared before the file gets its
+					// attributes, so a bad copy doesn't look up to date next time
+					verify := func(path string) {
+						if c.VerifyHash == "" || c.DryRun || !transfersuccess || !contentchanged {
+							return
+						}
+						verifiedhash, err = c.verifyFile(remotefi.Name, path)
+						if err != nil {
+							logger.Error().Msgf("Error verifying %s: %v", localpath, err)
+							transfererr = err
+							transfersuccess = false
+						}
+					}
+
+					if temppath != "" {
+						verify(temppath)
+						if transfersuccess {
+							// metadata goes on before the new file becomes visible
+							var tempfi FileInfo
+							tempfi, err = target.Stat(temppath)
+							if err == nil {
+								// an immutable file can't be renamed, so the
+								// flags go on after it's in place
+								wanted := remotefi
+								wanted.Flags = tempfi.Flags
+								err = target.ApplyChanges(temppath, tempfi, wanted, c.CompareOptions)
+							}
+							if err == nil {
+								err = target.Rename(temppath, localpath)
+							}
+							if err != nil {
+								logger.Error().Msgf("Error replacing %s with updated file: %v", localpath, err)
+								transfererr = err
+								transfersuccess = false
+							} else if tempfi.Flags == remotefi.Flags {
+								apply_attributes = false
+							} else {
+								localfi, err = target.Stat(localpath)
+								apply_attributes = err == nil
+								if err != nil {
+									logger.Error().Msgf("Error getting fileinfo for replaced file %s: %v", localpath, err)
+									transfererr = err
+								}
+							}
+						}
+						if !transfersuccess {
+							target.Remove(temppath)
+						}
+					} else if replace && transfersuccess && existingsize > remotefi.Size {
+						// everything matched, but there's extra at the end
+						err = target.Truncate(localpath, remotefi.Size)
+						if err != nil {
+							logger.Error().Msgf("Error truncating %s to %v bytes to match remote: %v", localpath, remotefi.Size, err)
+							transfererr = err
+							transfersuccess = false
+						}
+						contentchanged = true
+					}
+					if temppath == "" {
+						verify(localpath)
+					}
 				}
 
 				if apply_attributes && transfersuccess {
 					logger.Debug().Msgf("Updating metadata for %s", remotefi.Name)
-					err = localfi.ApplyChanges(remotefi)
+					err = target.ApplyChanges(localpath, localfi, remotefi, c.CompareOptions)
 					if err != nil {
 						logger.Error().Msgf("Error applying metadata for %s: %v", remotefi.Name, err)
+						transfererr = err
 					}
 				}
 
+				if contentchanged && !create_file && !typechanged {
+					differences = append(differences, "content")
+				}
+				changeentry := ChangeEntry{
+					Path:        localpath,
+					Bytes:       transferred,
+					Differences: differences,
+					Hash:        verifiedhash,
+					Btime:       birthTime(remotefi),
+				}
+				switch {
+				case transfererr != nil:
+					changeentry.Action = ChangeError
+					changeentry.Error = transfererr.Error()
+				case hardlinked:
+					changeentry.Action = ChangeHardlinked
+				case typechanged:
+					changeentry.Action = ChangeTypeChanged
+				case create_file:
+					changeentry.Action = ChangeCreated
+				case contentchanged:
+					changeentry.Action = ChangeContentUpdated
+				case apply_attributes:
+					changeentry.Action = ChangeMetadataOnly
+				}
+				if changeentry.Action != "" {
+					c.ChangeLog.Record(changeentry)
+				}
+
+				if transfererr != nil {
+					c.FailedInDir(filepath.Dir(remotefi.Name))
+				} else {
+					c.journal.FileCompleted(remotefi)
+				}
+
 				// handle inode counters
 				if remaininghardlinks == 0 {
 					// No more references, free up some memory
@@ -544,18 +1194,36 @@ func (c *Client) Run(client *rpc.Client) error {
 	return nil
 }
 
+// journalIdentity describes the source and everything that changes what a
+// sync does to a file, so a journal written with other options is discarded
+func (c *Client) journalIdentity(root FileInfo) string {
+	return fmt.Sprintf("%v:%v blocksize=%v checksum=%v acl=%v delete=%v/%v inplace=%v delta=%v verify=%v sparse=%v/%v hardlinks=%v compare=%+v users=%v groups=%v filter=%v",
+		root.Dev, root.Inode, c.BlockSize, c.AlwaysChecksum, c.SendACL, c.Delete, c.DeleteExcluded,
+		c.InPlace, c.Delta, c.VerifyHash, c.Sparse, c.SparseZeros, c.PreserveHardlinks,
+		c.CompareOptions, c.Users, c.Groups, c.Filter)
+}
+
+// mapOwner changes the owner and group of a source entry to the ones it
+// should have on the target
+func (c *Client) mapOwner(fi *FileInfo) {
+	fi.Owner = c.Users.Map(c.target, fi.Owner, fi.OwnerName)
+	fi.Group = c.Groups.Map(c.target, fi.Group, fi.GroupName)
+}
+
 func (c *Client) ProcessedItemInDir(path string) {
 	lookupdirectory := dirinfo{
 		name: path,
 	}
 	donewithdirectory := false
 	founddirectory := false
+	failed := false
 	c.dircache.AtomicMutate(lookupdirectory, func(item *dirinfo) {
 		founddirectory = true
 		left := atomic.AddInt32(&item.remaining, -1)
 		logger.Trace().Msgf("directory %s has usage %v left", item.name, left)
 		if left <= 0 { // zero for folders with contents, -1 for blank folders
 			c.PostProcessDir(item)
+			failed = item.failed
 			donewithdirectory = true // delete operation must be outside this atomic operation
 		}
 	}, false)
@@ -565,29 +1233,80 @@ func (c *Client) ProcessedItemInDir(path string) {
 	if donewithdirectory {
 		c.dircache.Delete(lookupdirectory)
 		if path != "/" {
+			if failed {
+				c.FailedInDir(filepath.Dir(path))
+			}
 			c.ProcessedItemInDir(filepath.Dir(path))
 		}
 	}
 }
 
+// FailedInDir marks a directory as not completely synced, so the journal is
+// kept for the next run
+func (c *Client) FailedInDir(path string) {
+	c.dircache.AtomicMutate(dirinfo{
+		name: path,
+	}, func(item *dirinfo) {
+		item.failed = true
+	}, false)
+}
+
 func (c *Client) PostProcessDir(item *dirinfo) {
 	if c.Delete {
 		for _, extraentry := range item.extraentries {
-			err := os.RemoveAll(filepath.Join(c.BasePath, item.name, extraentry))
+			err := c.target.RemoveAll(filepath.Join(item.name, extraentry))
 			if err != nil {
-				logger.Error().Msgf("Error unlinking %v: %v", filepath.Join(c.BasePath, item.name, extraentry), err)
+				logger.Error().Msgf("Error unlinking %v: %v", filepath.Join(item.name, extraentry), err)
+				c.ChangeLog.RecordError(filepath.Join(item.name, extraentry), err)
+				item.failed = true
+			} else {
+				c.ChangeLog.Record(ChangeEntry{
+					Path:   filepath.Join(item.name, extraentry),
+					Action: ChangeDeleted,
+				})
 			}
 			p.Add(EntriesDeleted, 1)
 		}
 	}
 
 	// Apply modify times to directory
-	localdirfi, err := PathToFileInfo(filepath.Join(c.BasePath, item.name))
+	localdirfi, err := c.target.Stat(item.name)
 	if err != nil {
-		logger.Error().Msgf("Problem getting local directory information for %v: %v", filepath.Join(c.BasePath, item.name), err)
+		logger.Error().Msgf("Problem getting local directory information for %v: %v", item.name, err)
+		item.failed = true
 	} else {
-		localdirfi.ApplyChanges(item.info)
+		if !c.SendACL {
+			localdirfi.ACL = nil
+			item.info.ACL = nil
+		}
+		diff := localdirfi.Compare(item.info, c.CompareOptions)
+		if diff.Metadata() {
+			err = c.target.ApplyChanges(item.name, localdirfi, item.info, c.CompareOptions)
+			if err != nil {
+				c.ChangeLog.RecordError(item.name, err)
+				item.failed = true
+			} else {
+				c.ChangeLog.Record(ChangeEntry{
+					Path:        item.name,
+					Action:      ChangeMetadataOnly,
+					Differences: diff.Differences(),
+				})
+			}
+		}
+	}
+
+	if !item.failed && item.name == "/" {
+		// everything is done, no need to resume anything
+		c.journal.Finish()
+	}
+}
+
+// DryRunSummary returns what a dry run would have done
+func (c *Client) DryRunSummary() string {
+	if c.dryrun == nil {
+		return ""
 	}
+	return c.dryrun.Summary()
 }
 
 func (c *Client) Abort() {
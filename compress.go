@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression is the algorithm used on a connection, written as none, s2,
+// s2-better or zstd[:level] where level is 1-22 like the zstd command
+type Compression struct {
+	Method string
+	Level  int
+}
+
+const defaultZstdLevel = 3
+
+var DefaultCompression = Compression{Method: "s2"}
+
+var ErrUnknownCompression = errors.New("unknown compression, use none, s2, s2-better or zstd[:level]")
+
+func ParseCompression(spec string) (Compression, error) {
+	method, level, haslevel := strings.Cut(strings.ToLower(spec), ":")
+	c := Compression{Method: method}
+	switch method {
+	case "none", "s2", "s2-better":
+		if haslevel {
+			return c, fmt.Errorf("compression %v has no levels", method)
+		}
+	case "zstd":
+		c.Level = defaultZstdLevel
+		if haslevel {
+			var err error
+			c.Level, err = strconv.Atoi(level)
+			if err != nil || c.Level < 1 || c.Level > 22 {
+				return c, fmt.Errorf("zstd level must be 1-22, not %v", level)
+			}
+		}
+	default:
+		return c, ErrUnknownCompression
+	}
+	return c, nil
+}
+
+func (c Compression) String() string {
+	if c.Method == "zstd" {
+		return c.Method + ":" + strconv.Itoa(c.Level)
+	}
+	return c.Method
+}
+
+// Negotiation runs on the connection after authentication and before any RPC
+// traffic. The client asks for a compression, or sends an empty string to
+// leave it to the server, and the server answers with what both sides will use:
+//
+//	client -> server: length byte, wanted compression
+//	server -> client: length byte, chosen compression
+
+func writeShortString(w io.Writer, s string) error {
+	_, err := w.Write(append([]byte{byte(len(s))}, s...))
+	return err
+}
+
+func readShortString(r io.Reader) (string, error) {
+	var length [1]byte
+	_, err := io.ReadFull(r, length[:])
+	if err != nil {
+		return "", err
+	}
+	s := make([]byte, length[0])
+	_, err = io.ReadFull(r, s)
+	return string(s), err
+}
+
+// ServerNegotiateCompression uses what the client asks for if we know it,
+// otherwise our own preference
+func ServerNegotiateCompression(rw io.ReadWriter, preferred Compression) (Compression, error) {
+	wanted, err := readShortString(rw)
+	if err != nil {
+		return preferred, err
+	}
+	chosen := preferred
+	if wanted != "" {
+		if c, err := ParseCompression(wanted); err == nil {
+			chosen = c
+		} else {
+			logger.Warn().Msgf("Client asked for compression %v which we don't support, using %v", wanted, preferred)
+		}
+	}
+	return chosen, writeShortString(rw, chosen.String())
+}
+
+// ClientNegotiateCompression asks for the wanted compression, where an empty
+// string lets the server decide
+func ClientNegotiateCompression(rw io.ReadWriter, wanted string) (Compression, error) {
+	err := writeShortString(rw, wanted)
+	if err != nil {
+		return Compression{}, err
+	}
+	chosen, err := readShortString(rw)
+	if err != nil {
+		return Compression{}, err
+	}
+	return ParseCompression(chosen)
+}
+
+// Each RPC message is sent as one frame, which is either raw or compressed on
+// its own. The RPC codec flushes after every message, so a frame never holds
+// half a message.
+//
+//	type byte, uvarint length, payload
+
+const (
+	frameRaw byte = iota
+	frameCompressed
+)
+
+// a directory listing with millions of entries is a big message, but not this big
+const maxFrameSize = 1 << 30
+
+// messages smaller than this are not worth compressing
+const minCompressSize = 64
+
+type compressedConn struct {
+	compression Compression
+	zenc        *zstd.Encoder
+	zdec        *zstd.Decoder
+
+	r    *bufio.Reader
+	w    io.Writer
+	c    io.Closer
+	wbuf []byte // message being written
+	cbuf []byte // compressed version of it
+	rbuf []byte // frame being read
+	dbuf []byte // decompressed version of it
+	rest []byte // what's left to Read of the current frame
+}
+
+func CompressedReadWriteCloser(rwc io.ReadWriteCloser, compression Compression) (io.ReadWriteCloser, error) {
+	cc := &compressedConn{
+		compression: compression,
+		r:           bufio.NewReader(rwc),
+		w:           rwc,
+		c:           rwc,
+	}
+	if compression.Method == "zstd" {
+		var err error
+		cc.zenc, err = zstd.NewWriter(nil,
+			zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(compression.Level)),
+			zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		cc.zdec, err = zstd.NewReader(nil,
+			zstd.WithDecoderConcurrency(1),
+			zstd.WithDecoderMaxMemory(maxFrameSize))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return cc, nil
+}
+
+func (c *compressedConn) Read(p []byte) (int, error) {
+	for len(c.rest) == 0 {
+		err := c.readFrame()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.rest)
+	c.rest = c.rest[n:]
+	return n, nil
+}
+
+func (c *compressedConn) readFrame() error {
+	frametype, err := c.r.ReadByte()
+	if err != nil {
+		return err
+	}
+	length, err := binary.ReadUvarint(c.r)
+	if err != nil {
+		return err
+	}
+	if length > maxFrameSize {
+		return fmt.Errorf("frame of %v bytes is too big", length)
+	}
+	if uint64(cap(c.rbuf)) < length {
+		c.rbuf = make([]byte, length)
+	}
+	c.rbuf = c.rbuf[:length]
+	_, err = io.ReadFull(c.r, c.rbuf)
+	if err != nil {
+		return err
+	}
+
+	switch frametype {
+	case frameRaw:
+		c.rest = c.rbuf
+	case frameCompressed:
+		switch c.compression.Method {
+		case "s2", "s2-better":
+			size, err := s2.DecodedLen(c.rbuf)
+			if err != nil {
+				return err
+			}
+			if size > maxFrameSize {
+				return fmt.Errorf("frame of %v bytes is too big", size)
+			}
+			c.dbuf, err = s2.Decode(c.dbuf[:cap(c.dbuf)], c.rbuf)
+			if err != nil {
+				return err
+			}
+		case "zstd":
+			c.dbuf, err = c.zdec.DecodeAll(c.rbuf, c.dbuf[:0])
+			if err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("got compressed frame on connection using %v", c.compression)
+		}
+		c.rest = c.dbuf
+	default:
+		return fmt.Errorf("unknown frame type %v", frametype)
+	}
+	return nil
+}
+
+// Write collects a message until Flush is called
+func (c *compressedConn) Write(p []byte) (int, error) {
+	c.wbuf = append(c.wbuf, p...)
+	return len(p), nil
+}
+
+// Flush sends the message written so far as one frame
+func (c *compressedConn) Flush() error {
+	if len(c.wbuf) == 0 {
+		return nil
+	}
+	frametype, payload := frameRaw, c.wbuf
+	if c.compression.Method != "none" && len(c.wbuf) >= minCompressSize && !incompressible(c.wbuf) {
+		switch c.compression.Method {
+		case "s2":
+			c.cbuf = s2.Encode(c.cbuf[:cap(c.cbuf)], c.wbuf)
+		case "s2-better":
+			c.cbuf = s2.EncodeBetter(c.cbuf[:cap(c.cbuf)], c.wbuf)
+		case "zstd":
+			c.cbuf = c.zenc.EncodeAll(c.wbuf, c.cbuf[:0])
+		}
+		if len(c.cbuf) < len(c.wbuf) {
+			frametype, payload = frameCompressed, c.cbuf
+		}
+	}
+
+	header := make([]byte, 1, 1+binary.MaxVarintLen64)
+	header[0] = frametype
+	header = binary.AppendUvarint(header, uint64(len(payload)))
+	_, err := c.w.Write(append(header, payload...))
+
+	// don't hang on to huge buffers after a big directory listing
+	if cap(c.wbuf) > 4*1024*1024 {
+		c.wbuf = nil
+		c.cbuf = nil
+	} else {
+		c.wbuf = c.wbuf[:0]
+	}
+	return err
+}
+
+func (c *compressedConn) Close() error {
+	if c.zenc != nil {
+		c.zenc.Close()
+	}
+	if c.zdec != nil {
+		c.zdec.Close()
+	}
+	return c.c.Close()
+}
+
+// incompressible guesses whether data is already compressed (media, archives,
+// encrypted files) by looking at the byte distribution of a few samples, so we
+// don't waste time trying to compress file blocks that won't get smaller
+func incompressible(data []byte) bool {
+	const samples = 4
+	const samplesize = 1024
+	if len(data) < samples*samplesize*4 {
+		// small messages are mostly metadata, always try those
+		return false
+	}
+	var counts [256]int
+	step := len(data) / samples
+	for i := 0; i < samples; i++ {
+		for _, b := range data[i*step : i*step+samplesize] {
+			counts[b]++
+		}
+	}
+	var entropy float64
+	for _, count := range counts {
+		if count > 0 {
+			frequency := float64(count) / (samples * samplesize)
+			entropy -= frequency * math.Log2(frequency)
+		}
+	}
+	// random data gives about 7.95 bits per byte with this sample size, text
+	// around 5 and executables around 6
+	return entropy > 7.8
+}
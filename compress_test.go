@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"net"
+	"testing"
+)
+
+// countingConn counts what goes over the wire
+type countingConn struct {
+	net.Conn
+	written int
+}
+
+func (cc *countingConn) Write(p []byte) (int, error) {
+	cc.written += len(p)
+	return cc.Conn.Write(p)
+}
+
+func TestCompressionRoundTrip(t *testing.T) {
+	random := make([]byte, 256*1024)
+	rand.New(rand.NewSource(1)).Read(random)
+	messages := [][]byte{
+		[]byte("tiny"),
+		bytes.Repeat([]byte("a directory listing compresses well "), 10000),
+		random,
+		bytes.Repeat([]byte{0}, 4*1024*1024+1), // bigger than the buffers that are kept
+		[]byte("after the big one"),
+	}
+
+	for _, spec := range []string{"none", "s2", "s2-better", "zstd:1", "zstd", "zstd:22"} {
+		compression, err := ParseCompression(spec)
+		if err != nil {
+			t.Fatalf("%v: %v", spec, err)
+		}
+		wconn, rconn := net.Pipe()
+		counter := &countingConn{Conn: wconn}
+		w, err := CompressedReadWriteCloser(counter, compression)
+		if err != nil {
+			t.Fatalf("%v: %v", spec, err)
+		}
+		r, err := CompressedReadWriteCloser(rconn, compression)
+		if err != nil {
+			t.Fatalf("%v: %v", spec, err)
+		}
+
+		var total int
+		for _, message := range messages {
+			total += len(message)
+		}
+		go func() {
+			for _, message := range messages {
+				// written in pieces like the RPC codec does
+				w.Write(message[:len(message)/2])
+				w.Write(message[len(message)/2:])
+				w.(*compressedConn).Flush()
+			}
+			w.Close()
+		}()
+		for i, message := range messages {
+			got := make([]byte, len(message))
+			if _, err := io.ReadFull(r, got); err != nil {
+				t.Fatalf("%v: reading message %v: %v", spec, i, err)
+			}
+			if !bytes.Equal(got, message) {
+				t.Errorf("%v: message %v of %v bytes came back different", spec, i, len(message))
+			}
+		}
+		if _, err := r.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("%v: expected the end after the last message, got %v", spec, err)
+		}
+		r.Close()
+
+		if compression.Method == "none" && counter.written <= total {
+			t.Errorf("%v: %v bytes sent for %v bytes of messages", spec, counter.written, total)
+		}
+		if compression.Method != "none" && counter.written > total/2 {
+			t.Errorf("%v: %v bytes sent for %v bytes of mostly compressible messages", spec, counter.written, total)
+		}
+	}
+}
+
+func TestParseCompression(t *testing.T) {
+	for spec, expected := range map[string]Compression{
+		"none":      {Method: "none"},
+		"S2":        {Method: "s2"},
+		"s2-better": {Method: "s2-better"},
+		"zstd":      {Method: "zstd", Level: defaultZstdLevel},
+		"zstd:1":    {Method: "zstd", Level: 1},
+		"zstd:22":   {Method: "zstd", Level: 22},
+	} {
+		c, err := ParseCompression(spec)
+		if err != nil || c != expected {
+			t.Errorf("%v parsed as %+v: %v", spec, c, err)
+		}
+		if again, err := ParseCompression(c.String()); err != nil || again != c {
+			t.Errorf("%v written as %v parsed as %+v: %v", spec, c, again, err)
+		}
+	}
+	for _, spec := range []string{"", "lz4", "s2:3", "none:1", "zstd:0", "zstd:23", "zstd:fast"} {
+		if c, err := ParseCompression(spec); err == nil {
+			t.Errorf("%v was accepted as %+v", spec, c)
+		}
+	}
+}
+
+// negotiate runs both sides of the negotiation over an in-memory connection
+func negotiate(t *testing.T, wanted string, preferred Compression) (client, server Compression, clienterr error) {
+	t.Helper()
+	clientconn, serverconn := net.Pipe()
+	defer clientconn.Close()
+	defer serverconn.Close()
+	done := make(chan error)
+	go func() {
+		var err error
+		server, err = ServerNegotiateCompression(serverconn, preferred)
+		done <- err
+	}()
+	client, clienterr = ClientNegotiateCompression(clientconn, wanted)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	return client, server, clienterr
+}
+
+func TestNegotiateCompression(t *testing.T) {
+	preferred := Compression{Method: "zstd", Level: 5}
+	for wanted, expected := range map[string]Compression{
+		"":          preferred,
+		"none":      {Method: "none"},
+		"s2-better": {Method: "s2-better"},
+		"zstd:19":   {Method: "zstd", Level: 19},
+		// something a newer client knows and we don't
+		"lz4": preferred,
+	} {
+		client, server, err := negotiate(t, wanted, preferred)
+		if err != nil {
+			t.Errorf("asking for %q: %v", wanted, err)
+			continue
+		}
+		if client != expected || server != expected {
+			t.Errorf("asking for %q gave %v on the client and %v on the server, expected %v", wanted, client, server, expected)
+		}
+	}
+}
+
+func TestNegotiateUnknownCompression(t *testing.T) {
+	// a newer server picking something we don't know has to fail, not fall
+	// back to something the server isn't using
+	clientconn, serverconn := net.Pipe()
+	defer clientconn.Close()
+	defer serverconn.Close()
+	go func() {
+		readShortString(serverconn)
+		writeShortString(serverconn, "lz4")
+	}()
+	if c, err := ClientNegotiateCompression(clientconn, ""); err == nil {
+		t.Errorf("server choosing an unknown compression gave %v", c)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+var ErrOutsideBase = errors.New("path resolves outside of the served directory")
+
+// PathConfiner makes sure that client supplied paths can never be used to
+// access anything outside BasePath, neither with ../ tricks nor by following
+// symlinks inside the tree. All server side file access goes through it.
+type PathConfiner struct {
+	BasePath string
+
+	once     sync.Once
+	native   confinerNative
+	resolved string // BasePath with symlinks resolved, for the userspace fallback
+}
+
+func NewPathConfiner(basepath string) *PathConfiner {
+	return &PathConfiner{
+		BasePath: basepath,
+	}
+}
+
+func (pc *PathConfiner) init() {
+	pc.once.Do(func() {
+		resolved, err := filepath.EvalSymlinks(pc.BasePath)
+		if err != nil {
+			resolved = pc.BasePath
+		}
+		pc.resolved = resolved
+		pc.native.init(pc.BasePath)
+	})
+}
+
+// relative cleans a client supplied path and returns it relative to the base,
+// or "." for the base itself. Paths that lexically escape the base are rejected.
+func (pc *PathConfiner) relative(path string) (string, error) {
+	rel, err := filepath.Rel(pc.BasePath, filepath.Join(pc.BasePath, path))
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", &fs.PathError{Op: "confine", Path: path, Err: ErrOutsideBase}
+	}
+	return rel, nil
+}
+
+// ParentDir is the directory an entry is in, held open so that everything
+// done to the entry happens in that directory, even if someone swaps it or
+// one above it for a symlink at the same time. Only the last element is
+// looked up by name, so it's only safe to use with operations that don't
+// follow symlinks (lstat, lchown, mknod, unlink etc.)
+type ParentDir struct {
+	dir  *os.File // nil with the userspace fallback, which only has the path
+	path string   // of the directory when it was opened
+	name string   // last element of the entry, "." for the base itself
+}
+
+// Parent opens the directory of a client supplied path, after checking that
+// it's beneath the base. It must be closed when done.
+func (pc *PathConfiner) Parent(path string) (*ParentDir, error) {
+	pc.init()
+	rel, err := pc.relative(path)
+	if err != nil {
+		return nil, err
+	}
+	parent, name := filepath.Dir(rel), filepath.Base(rel)
+	if rel == "." {
+		parent = "."
+	}
+	dir, err := pc.native.openBeneath(pc.BasePath, parent, unixPathFlags, 0)
+	if err != errConfinerUnsupported {
+		if err != nil {
+			return nil, err
+		}
+		return &ParentDir{dir: dir, path: filepath.Join(pc.BasePath, parent), name: name}, nil
+	}
+	resolved, err := pc.resolveBeneath(parent)
+	if err != nil {
+		return nil, err
+	}
+	return &ParentDir{path: resolved, name: name}, nil
+}
+
+// IsBase is true if the entry is the base directory itself
+func (pd *ParentDir) IsBase() bool {
+	return pd.name == "."
+}
+
+// Path returns a path to the entry that is resolved through the open
+// directory, for functions that don't follow the last element
+func (pd *ParentDir) Path() string {
+	if pd.dir == nil {
+		return filepath.Join(pd.path, pd.name)
+	}
+	return entryPath(pd.dir, pd.name)
+}
+
+func (pd *ParentDir) Close() error {
+	if pd.dir == nil {
+		return nil
+	}
+	return pd.dir.Close()
+}
+
+// OpenFile opens a client supplied path, following symlinks only as long as
+// they stay beneath the base
+func (pc *PathConfiner) OpenFile(path string, flag int, perm fs.FileMode) (*os.File, error) {
+	pc.init()
+	rel, err := pc.relative(path)
+	if err != nil {
+		return nil, err
+	}
+	f, err := pc.native.openBeneath(pc.BasePath, rel, flag, perm)
+	if err != errConfinerUnsupported {
+		return f, err
+	}
+	resolved, err := pc.resolveBeneath(rel)
+	if err != nil {
+		return nil, err
+	}
+	return os.OpenFile(resolved, flag, perm)
+}
+
+// resolveBeneath is the userspace fallback, which resolves all symlinks in the
+// path and checks the result. It's racy if someone is moving things around in
+// the tree at the same time, which the native implementations are not.
+func (pc *PathConfiner) resolveBeneath(rel string) (string, error) {
+	resolved, err := filepath.EvalSymlinks(filepath.Join(pc.BasePath, rel))
+	if err != nil {
+		if os.IsNotExist(err) {
+			// creating something new, the parent must be fine then
+			parent, err := pc.resolveBeneath(filepath.Dir(rel))
+			if err != nil {
+				return "", err
+			}
+			return filepath.Join(parent, filepath.Base(rel)), nil
+		}
+		return "", err
+	}
+	if resolved != pc.resolved && !strings.HasPrefix(resolved, pc.resolved+string(filepath.Separator)) {
+		return "", &fs.PathError{Op: "confine", Path: rel, Err: ErrOutsideBase}
+	}
+	return resolved, nil
+}
@@ -0,0 +1,113 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	unix "golang.org/x/sys/unix"
+)
+
+var errConfinerUnsupported = errors.New("native path confinement not supported")
+
+// confinerNative uses openat2 with RESOLVE_BENEATH, so the kernel refuses to
+// resolve anything outside the base directory
+type confinerNative struct {
+	basefd      int
+	unsupported atomic.Bool
+}
+
+// procAvailable is false if /proc isn't mounted, then entries are reached by
+// path like in the userspace fallback
+var procAvailable = sync.OnceValue(func() bool {
+	_, err := os.Stat("/proc/self/fd")
+	return err == nil
+})
+
+func (cn *confinerNative) init(basepath string) {
+	if !procAvailable() {
+		logger.Warn().Msg("/proc isn't mounted, using userspace path confinement")
+		cn.unsupported.Store(true)
+		return
+	}
+	fd, err := unix.Open(basepath, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		logger.Warn().Msgf("Could not open %v for path confinement, using userspace fallback: %v", basepath, err)
+		cn.unsupported.Store(true)
+	}
+	cn.basefd = fd
+}
+
+func (cn *confinerNative) openat2(rel string, flag int, perm fs.FileMode) (int, error) {
+	if cn.unsupported.Load() {
+		return -1, errConfinerUnsupported
+	}
+	fd, err := unix.Openat2(cn.basefd, rel, &unix.OpenHow{
+		Flags:   uint64(flag | unix.O_CLOEXEC),
+		Mode:    uint64(perm.Perm()),
+		Resolve: unix.RESOLVE_BENEATH | unix.RESOLVE_NO_MAGICLINKS,
+	})
+	switch err {
+	case nil:
+		return fd, nil
+	case unix.ENOSYS:
+		// kernel older than 5.6, don't try again
+		if !cn.unsupported.Swap(true) {
+			logger.Warn().Msg("Kernel does not support openat2, using userspace path confinement")
+		}
+		return -1, errConfinerUnsupported
+	case unix.EXDEV:
+		return -1, &fs.PathError{Op: "openat2", Path: rel, Err: ErrOutsideBase}
+	}
+	return -1, &fs.PathError{Op: "openat2", Path: rel, Err: err}
+}
+
+func (cn *confinerNative) openBeneath(basepath, rel string, flag int, perm fs.FileMode) (*os.File, error) {
+	fd, err := cn.openat2(rel, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return os.NewFile(uintptr(fd), filepath.Join(basepath, rel)), nil
+}
+
+// unixPathFlags opens a directory only to use it as a starting point
+const unixPathFlags = unix.O_PATH | unix.O_DIRECTORY
+
+// entryPath returns a path to name in an open directory, which the kernel
+// resolves through the file descriptor instead of the path it was opened as
+func entryPath(dir *os.File, name string) string {
+	if !procAvailable() {
+		return filepath.Join(dir.Name(), name)
+	}
+	return "/proc/self/fd/" + strconv.Itoa(int(dir.Fd())) + "/" + name
+}
+
+// noFollow calls fn with a path for the entry at path that can't be swapped
+// for a symlink, for functions that always follow symlinks like chmod. It
+// refuses symlinks.
+func noFollow(path string, fn func(path string) error) error {
+	if !procAvailable() {
+		return fn(path)
+	}
+	fd, err := unix.Open(path, unix.O_PATH|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return &fs.PathError{Op: "open", Path: path, Err: err}
+	}
+	defer unix.Close(fd)
+	var stat unix.Stat_t
+	err = unix.Fstat(fd, &stat)
+	if err != nil {
+		return &fs.PathError{Op: "fstat", Path: path, Err: err}
+	}
+	if stat.Mode&unix.S_IFMT == unix.S_IFLNK {
+		return ErrTypeError
+	}
+	return fn("/proc/self/fd/" + strconv.Itoa(fd))
+}
@@ -0,0 +1,36 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+var errConfinerUnsupported = errors.New("native path confinement not supported")
+
+// confinerNative has no kernel support on this platform, so everything is
+// handled by the userspace fallback
+type confinerNative struct{}
+
+func (cn *confinerNative) init(basepath string) {}
+
+func (cn *confinerNative) openBeneath(basepath, rel string, flag int, perm fs.FileMode) (*os.File, error) {
+	return nil, errConfinerUnsupported
+}
+
+// unixPathFlags isn't used, as there's no native confinement
+const unixPathFlags = 0
+
+func entryPath(dir *os.File, name string) string {
+	return filepath.Join(dir.Name(), name)
+}
+
+// noFollow can't pin the entry here, so it's as racy as the userspace
+// confinement
+func noFollow(path string, fn func(path string) error) error {
+	return fn(path)
+}
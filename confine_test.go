@@ -0,0 +1,246 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+)
+
+// newConfineTest makes a writable server on base, next to a directory
+// outside it with a file that must never be touched
+func newConfineTest(t *testing.T) (s *Server, base, outside string) {
+	dir := t.TempDir()
+	base = filepath.Join(dir, "base")
+	outside = filepath.Join(dir, "outside")
+	for _, d := range []string{base, outside} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return NewServer(base, false), base, outside
+}
+
+// checkOutside fails if anything in outside was added, removed or changed
+func checkOutside(t *testing.T, outside string) {
+	t.Helper()
+	entries, err := os.ReadDir(outside)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if entry.Name() != "secret" {
+			t.Errorf("%v was created outside the base", entry.Name())
+		}
+	}
+	info, err := os.Lstat(filepath.Join(outside, "secret"))
+	if err != nil {
+		t.Fatalf("secret outside the base is gone: %v", err)
+	}
+	if info.Mode() != 0600 || info.Size() != 6 {
+		t.Errorf("secret outside the base was changed to %v with %v bytes", info.Mode(), info.Size())
+	}
+}
+
+func regularFile(mode fs.FileMode) FileInfoArgs {
+	return FileInfoArgs{Info: FileInfo{Mode: mode, Permissions: uint32(mode)}}
+}
+
+func TestConfineDotDot(t *testing.T) {
+	s, _, outside := newConfineTest(t)
+	for _, path := range []string{"..", "../outside/secret", "a/../../outside/secret", "/../outside/secret", "./../outside"} {
+		var fi FileInfo
+		if err := s.Stat(path, &fi); !errors.Is(err, ErrOutsideBase) {
+			t.Errorf("Stat(%q) gave %v, expected %v", path, err, ErrOutsideBase)
+		}
+		if err := s.Mkdir(path+"/escaped", nil); !errors.Is(err, ErrOutsideBase) {
+			t.Errorf("Mkdir(%q) gave %v, expected %v", path, err, ErrOutsideBase)
+		}
+		if err := s.Delete(DeleteArgs{Path: path, Recursive: true}, nil); !errors.Is(err, ErrOutsideBase) {
+			t.Errorf("Delete(%q) gave %v, expected %v", path, err, ErrOutsideBase)
+		}
+	}
+	checkOutside(t, outside)
+}
+
+func TestConfineAbsolutePath(t *testing.T) {
+	s, base, outside := newConfineTest(t)
+	var fi FileInfo
+	if err := s.Stat(filepath.Join(outside, "secret"), &fi); !os.IsNotExist(err) {
+		t.Errorf("Stat of absolute path outside the base gave %v, expected it to be looked up beneath the base", err)
+	}
+	if err := s.Mkdir(filepath.Join(outside, "created"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(base, outside, "created")); err != nil {
+		t.Errorf("absolute path wasn't created beneath the base: %v", err)
+	}
+	checkOutside(t, outside)
+}
+
+func TestConfineSymlinkedDirectory(t *testing.T) {
+	s, base, outside := newConfineTest(t)
+	if err := os.Symlink(outside, filepath.Join(base, "link")); err != nil {
+		t.Fatal(err)
+	}
+	var fi FileInfo
+	if err := s.Stat("link/secret", &fi); err == nil {
+		t.Error("Stat through symlinked directory worked")
+	}
+	if err := s.Mkdir("link/created", nil); err == nil {
+		t.Error("Mkdir through symlinked directory worked")
+	}
+	args := regularFile(0644)
+	args.Path = "link/created"
+	if err := s.Create(args, nil); err == nil {
+		t.Error("Create through symlinked directory worked")
+	}
+	fifo := FileInfoArgs{Path: "link/fifo", Info: FileInfo{Mode: fs.ModeNamedPipe | 0644}}
+	if err := s.Create(fifo, nil); err == nil {
+		t.Error("Create of FIFO through symlinked directory worked")
+	}
+	if err := s.Truncate(TruncateArgs{Path: "link/secret"}, nil); err == nil {
+		t.Error("Truncate through symlinked directory worked")
+	}
+	if err := s.Link(LinkArgs{OldPath: "link/secret", NewPath: "stolen"}, nil); err == nil {
+		t.Error("Link from symlinked directory worked")
+	}
+	if err := s.Rename(RenameArgs{OldPath: "link/secret", NewPath: "stolen"}, nil); err == nil {
+		t.Error("Rename from symlinked directory worked")
+	}
+	if err := s.Delete(DeleteArgs{Path: "link/secret"}, nil); err == nil {
+		t.Error("Delete through symlinked directory worked")
+	}
+	var reply OpenReply
+	if err := NewConnection(s).Open("link/secret", &reply); err == nil {
+		t.Error("Open through symlinked directory worked")
+	}
+	checkOutside(t, outside)
+}
+
+func TestConfineSymlinkLastElement(t *testing.T) {
+	s, base, outside := newConfineTest(t)
+	if err := os.Symlink(filepath.Join(outside, "secret"), filepath.Join(base, "leaf")); err != nil {
+		t.Fatal(err)
+	}
+	var fi FileInfo
+	if err := s.Stat("leaf", &fi); err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode&fs.ModeSymlink == 0 {
+		t.Errorf("Stat followed the symlink, got mode %v", fi.Mode)
+	}
+
+	args := regularFile(0777)
+	args.Path = "leaf"
+	args.Info.Mtim = fi.Mtim
+	if err := s.ApplyChanges(args, nil); err != ErrTypeError {
+		t.Errorf("ApplyChanges of a file to a symlink gave %v, expected %v", err, ErrTypeError)
+	}
+	if err := s.Create(args, nil); err == nil {
+		t.Error("Create of a file over a symlink worked")
+	}
+	if err := s.Truncate(TruncateArgs{Path: "leaf"}, nil); err == nil {
+		t.Error("Truncate through a symlink worked")
+	}
+	var reply OpenReply
+	if err := NewConnection(s).Open("leaf", &reply); err == nil {
+		t.Error("Open through a symlink worked")
+	}
+	if err := s.Rename(RenameArgs{OldPath: "leaf", NewPath: "moved"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete(DeleteArgs{Path: "moved", Recursive: true}, nil); err != nil {
+		t.Fatal(err)
+	}
+	checkOutside(t, outside)
+}
+
+func TestConfineSwappedDirectory(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("only the Linux confinement holds the directory open")
+	}
+	s, base, outside := newConfineTest(t)
+	if err := os.Mkdir(filepath.Join(base, "d"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// swapping the directory after it's opened doesn't redirect anything
+	parent, err := s.root.Parent("d/created")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parent.dir == nil {
+		t.Skip("native confinement isn't available on this kernel")
+	}
+	if err := os.Rename(filepath.Join(base, "d"), filepath.Join(base, "d.old")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(base, "d")); err != nil {
+		t.Fatal(err)
+	}
+	err = os.Mkdir(parent.Path(), 0755)
+	parent.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(base, "d.old", "created")); err != nil {
+		t.Errorf("entry wasn't created in the directory that was opened: %v", err)
+	}
+	checkOutside(t, outside)
+
+	// and the same with the swapping going on while the server works
+	if err := os.Remove(filepath.Join(base, "d")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(base, "d.old"), filepath.Join(base, "d")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(base, "d", "secret"), []byte("inside"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var wanted FileInfo
+	if err := s.Stat("d/secret", &wanted); err != nil {
+		t.Fatal(err)
+	}
+	wanted.Mode = 0777
+	wanted.Permissions = 0777
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		d, real, link := filepath.Join(base, "d"), filepath.Join(base, "d.real"), filepath.Join(base, "d.link")
+		os.Symlink(outside, link)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			// swap d between the real directory and a symlink to outside
+			os.Rename(d, real)
+			os.Rename(link, d)
+			os.Rename(d, link)
+			os.Rename(real, d)
+		}
+	}()
+	for i := 0; i < 2000; i++ {
+		s.Mkdir("d/created", nil)
+		s.Delete(DeleteArgs{Path: "d/created", Recursive: true}, nil)
+		s.ApplyChanges(FileInfoArgs{Path: "d/secret", Info: wanted}, nil)
+		s.Create(FileInfoArgs{Path: "d/fifo", Info: FileInfo{Mode: fs.ModeNamedPipe | 0644}}, nil)
+		s.Rename(RenameArgs{OldPath: "d/fifo", NewPath: "d/moved"}, nil)
+		s.Delete(DeleteArgs{Path: "d/moved"}, nil)
+	}
+	close(stop)
+	wg.Wait()
+	checkOutside(t, outside)
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"hash"
+	"os"
+	"sync/atomic"
+
+	"github.com/lkarlslund/gonk"
+)
+
+var (
+	ErrHandleNotFound   = errors.New("file handle not found")
+	ErrTooManyOpenFiles = errors.New("server has too many open files, try again with fewer parallel files")
+)
+
+type filehandle struct {
+	id    uint64
+	name  string
+	fh    *os.File
+	delta *deltaIndex // signature of the old file when doing a delta transfer
+	times *FileInfo   // access time to put back when closing, see openRead
+
+	hash   hash.Hash // strong hash being computed by HashRange
+	hashed int64     // how much of the file is in it
+}
+
+func (fh filehandle) Compare(fh2 filehandle) int {
+	return cmp.Compare(fh.id, fh2.id)
+}
+
+// Connection serves the RPCs of one client connection. Open files are only
+// known on the connection that opened them, and are closed when it goes away.
+// Everything that works on paths is handled by the embedded Server.
+type Connection struct {
+	*Server
+
+	handles    gonk.Gonk[filehandle]
+	lasthandle atomic.Uint64
+}
+
+func NewConnection(s *Server) *Connection {
+	return &Connection{
+		Server: s,
+	}
+}
+
+// OpenReply identifies an opened file in later calls
+type OpenReply struct {
+	Handle uint64
+	Size   int64
+}
+
+func (c *Connection) open(path string, flag int, reply *OpenReply) error {
+	if open := c.openfiles.Add(1); c.MaxOpenFiles > 0 && open > int64(c.MaxOpenFiles) {
+		c.openfiles.Add(-1)
+		return ErrTooManyOpenFiles
+	}
+	var h *os.File
+	var times *FileInfo
+	var err error
+	if flag == os.O_RDONLY {
+		h, times, err = c.openRead(path)
+	} else {
+		h, err = c.root.OpenFile(path, flag, 0)
+	}
+	if err != nil {
+		c.openfiles.Add(-1)
+		return err
+	}
+	info, err := h.Stat()
+	if err != nil {
+		closeRead(h, times)
+		c.openfiles.Add(-1)
+		return err
+	}
+	id := c.lasthandle.Add(1)
+	c.handles.Store(filehandle{
+		id:    id,
+		name:  path,
+		fh:    h,
+		times: times,
+	})
+	*reply = OpenReply{
+		Handle: id,
+		Size:   info.Size(),
+	}
+	return nil
+}
+
+func (c *Connection) handle(id uint64) (filehandle, error) {
+	fh, found := c.handles.Load(filehandle{
+		id: id,
+	})
+	if !found {
+		return fh, ErrHandleNotFound
+	}
+	return fh, nil
+}
+
+func (c *Connection) release(fh filehandle) error {
+	if !c.handles.Delete(fh) {
+		return ErrHandleNotFound
+	}
+	c.openfiles.Add(-1)
+	return closeRead(fh.fh, fh.times)
+}
+
+// CloseAll closes the files the client left open, when it disconnects
+func (c *Connection) CloseAll() {
+	var open []filehandle
+	c.handles.Range(func(fh filehandle) bool {
+		open = append(open, fh)
+		return true
+	})
+	for _, fh := range open {
+		logger.Debug().Msgf("Closing %s left open by client", fh.name)
+		c.release(fh)
+	}
+}
+
+func (c *Connection) Open(path string, reply *OpenReply) error {
+	logger.Trace().Msgf("Opening file %s", path)
+	return c.open(path, os.O_RDONLY, reply)
+}
+
+func (c *Connection) GetChunk(args GetChunkArgs, data *[]byte) error {
+	fh, err := c.handle(args.Handle)
+	if err != nil {
+		return err
+	}
+	logger.Trace().Msgf("Getting chunk from file %s at offset %d size %d", fh.name, args.Offset, args.Size)
+	if args.Size > maxChunkSize {
+		return ErrChunkTooLarge
+	}
+	d := make([]byte, args.Size)
+	n, err := fh.fh.ReadAt(d, int64(args.Offset))
+	if err != nil {
+		return err
+	}
+	if n != int(args.Size) {
+		return errors.New("end of file reached")
+	}
+	*data = d
+	return nil
+}
+
+// Signature returns the signatures of the blocks in part of an open file
+func (c *Connection) Signature(args SignatureArgs, reply *Signature) error {
+	fh, err := c.handle(args.Handle)
+	if err != nil {
+		return err
+	}
+	logger.Trace().Msgf("Computing signature for file %s with block size %d at offset %d size %d", fh.name, args.BlockSize, args.Offset, args.Size)
+	if args.BlockSize <= 0 || args.Offset%args.BlockSize != 0 {
+		return errors.New("invalid block size")
+	}
+	info, err := fh.fh.Stat()
+	if err != nil {
+		return err
+	}
+	blocks, err := computeBlockSignatures(fh.fh, info.Size(), args.BlockSize, args.Offset, args.Offset+args.Size)
+	if err != nil {
+		return err
+	}
+	*reply = Signature{
+		Size:      info.Size(),
+		BlockSize: args.BlockSize,
+		Blocks:    blocks,
+	}
+	return nil
+}
+
+func (c *Connection) Delta(args DeltaArgs, reply *DeltaResponse) error {
+	if args.Signature != nil {
+		if args.Signature.BlockSize <= 0 {
+			return errors.New("invalid block size")
+		}
+		if args.Signature.BlockSize > maxChunkSize {
+			return ErrChunkTooLarge
+		}
+		index := newDeltaIndex(*args.Signature)
+		c.handles.AtomicMutate(filehandle{
+			id: args.Handle,
+		}, func(fh *filehandle) {
+			fh.delta = index
+		}, false)
+	}
+	fh, err := c.handle(args.Handle)
+	if err != nil {
+		return err
+	}
+	logger.Trace().Msgf("Computing delta for file %s at offset %d size %d", fh.name, args.Offset, args.Size)
+	if args.Size > maxChunkSize*deltaBlocksPerRequest {
+		return ErrChunkTooLarge
+	}
+	if fh.delta == nil {
+		return errors.New("no signature for delta")
+	}
+	info, err := fh.fh.Stat()
+	if err != nil {
+		return err
+	}
+	response, err := fh.delta.Delta(fh.fh, info.Size(), args.Offset, args.Size)
+	if err != nil {
+		return err
+	}
+	*reply = response
+	return nil
+}
+
+// ChecksumFile returns the hashes of all blocks in an open file
+func (c *Connection) ChecksumFile(args ChecksumFileArgs, checksums *[]uint64) error {
+	fh, err := c.handle(args.Handle)
+	if err != nil {
+		return err
+	}
+	logger.Trace().Msgf("Checksumming file %s with block size %d", fh.name, args.BlockSize)
+	info, err := fh.fh.Stat()
+	if err != nil {
+		return err
+	}
+	hashes, err := ChecksumBlocks(fh.fh, 0, info.Size(), args.BlockSize)
+	*checksums = hashes
+	return err
+}
+
+// ChecksumRange returns the hashes of the blocks in part of an open file
+func (c *Connection) ChecksumRange(args ChecksumRangeArgs, checksums *[]uint64) error {
+	fh, err := c.handle(args.Handle)
+	if err != nil {
+		return err
+	}
+	logger.Trace().Msgf("Checksumming file %s at offset %d size %d with block size %d", fh.name, args.Offset, args.Size, args.BlockSize)
+	hashes, err := ChecksumBlocks(fh.fh, args.Offset, args.Size, args.BlockSize)
+	*checksums = hashes
+	return err
+}
+
+func (c *Connection) Close(handle uint64, reply *interface{}) error {
+	fh, err := c.handle(handle)
+	if err != nil {
+		return err
+	}
+	logger.Trace().Msgf("Closing file %s", fh.name)
+	return c.release(fh)
+}
+
+// Write side RPCs used when a client is pushing to us
+
+func (c *Connection) OpenWrite(path string, reply *OpenReply) error {
+	if c.ReadOnly {
+		return ErrReadOnly
+	}
+	logger.Trace().Msgf("Opening file %s for writing", path)
+	return c.open(path, os.O_RDWR, reply)
+}
+
+func (c *Connection) WriteChunk(args WriteChunkArgs, reply *interface{}) error {
+	if c.ReadOnly {
+		return ErrReadOnly
+	}
+	fh, err := c.handle(args.Handle)
+	if err != nil {
+		return err
+	}
+	logger.Trace().Msgf("Writing chunk to file %s at offset %d size %d", fh.name, args.Offset, len(args.Data))
+	n, err := fh.fh.WriteAt(args.Data, int64(args.Offset))
+	if err != nil {
+		return err
+	}
+	if n != len(args.Data) {
+		return errors.New("short write")
+	}
+	return nil
+}
+
+func (c *Connection) CopyChunk(args CopyChunkArgs, reply *interface{}) error {
+	if c.ReadOnly {
+		return ErrReadOnly
+	}
+	from, err := c.handle(args.From)
+	if err != nil {
+		return err
+	}
+	to, err := c.handle(args.To)
+	if err != nil {
+		return err
+	}
+	logger.Trace().Msgf("Copying chunk from file %s at offset %d to %s at offset %d size %d", from.name, args.FromOffset, to.name, args.Offset, args.Size)
+	if args.Size > maxChunkSize {
+		return ErrChunkTooLarge
+	}
+	data := make([]byte, args.Size)
+	n, err := from.fh.ReadAt(data, int64(args.FromOffset))
+	if err != nil {
+		return err
+	}
+	if n != int(args.Size) {
+		return errors.New("end of file reached")
+	}
+	n, err = to.fh.WriteAt(data, int64(args.Offset))
+	if err != nil {
+		return err
+	}
+	if n != len(data) {
+		return errors.New("short write")
+	}
+	return nil
+}
+
+func (c *Connection) Sync(handle uint64, reply *interface{}) error {
+	if c.ReadOnly {
+		return ErrReadOnly
+	}
+	fh, err := c.handle(handle)
+	if err != nil {
+		return err
+	}
+	logger.Trace().Msgf("Syncing file %s", fh.name)
+	return fh.fh.Sync()
+}
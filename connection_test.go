@@ -0,0 +1,56 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestChunkSizeLimit(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "file"), []byte("some content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := NewConnection(NewServer(dir, false))
+	defer c.CloseAll()
+	var from, to OpenReply
+	if err := c.Open("file", &from); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.OpenWrite("file", &to); err != nil {
+		t.Fatal(err)
+	}
+
+	huge := uint64(1) << 62
+	var data []byte
+	if err := c.GetChunk(GetChunkArgs{Handle: from.Handle, Size: huge}, &data); err != ErrChunkTooLarge {
+		t.Errorf("getting a huge chunk gave %v", err)
+	}
+	if err := c.CopyChunk(CopyChunkArgs{From: from.Handle, To: to.Handle, Size: huge}, nil); err != ErrChunkTooLarge {
+		t.Errorf("copying a huge chunk gave %v", err)
+	}
+	var checksums []uint64
+	if err := c.ChecksumRange(ChecksumRangeArgs{Handle: from.Handle, BlockSize: int64(huge), Size: 12}, &checksums); err != ErrChunkTooLarge {
+		t.Errorf("checksumming with a huge block size gave %v", err)
+	}
+	var sig Signature
+	if err := c.Signature(SignatureArgs{Handle: from.Handle, BlockSize: int64(huge), Size: 12}, &sig); err != ErrChunkTooLarge {
+		t.Errorf("signature with a huge block size gave %v", err)
+	}
+	var delta DeltaResponse
+	if err := c.Delta(DeltaArgs{Handle: from.Handle, Signature: &Signature{BlockSize: int64(huge)}}, &delta); err != ErrChunkTooLarge {
+		t.Errorf("delta with a huge block size gave %v", err)
+	}
+
+	// lots of tiny blocks past the end of the file mustn't allocate for all of them
+	if err := c.ChecksumRange(ChecksumRangeArgs{Handle: from.Handle, BlockSize: 1, Size: int64(huge)}, &checksums); err == nil {
+		t.Error("checksumming past the end of the file worked")
+	}
+	if err := c.Signature(SignatureArgs{Handle: from.Handle, BlockSize: 1, Size: int64(huge)}, &sig); err != nil || len(sig.Blocks) != 12 {
+		t.Errorf("signature of tiny blocks has %v blocks: %v", len(sig.Blocks), err)
+	}
+
+	if err := c.GetChunk(GetChunkArgs{Handle: from.Handle, Size: 4}, &data); err != nil || string(data) != "some" {
+		t.Errorf("getting a normal chunk gave %q: %v", data, err)
+	}
+}
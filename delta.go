@@ -0,0 +1,248 @@
+package main
+
+import (
+	"io"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// Delta transfer works like rsync: the side that has the old file sends a
+// signature of its blocks, and the side with the new file finds those blocks
+// at any offset using a rolling checksum. What's left is sent as literal data.
+
+// BlockSignature identifies a block of the old file. The weak checksum can be
+// rolled along a byte at a time, the strong one confirms a match.
+type BlockSignature struct {
+	Weak   uint32
+	Strong uint64
+}
+
+// Signature of a file, where the last block can be shorter than the others
+type Signature struct {
+	Size      int64
+	BlockSize int64
+	Blocks    []BlockSignature
+}
+
+// DeltaOp is either a copy of a range of the old file, or literal data
+type DeltaOp struct {
+	Copy       bool
+	CopyOffset int64 // where to copy from in the old file
+	Size       int64
+	Data       []byte
+}
+
+// how much of the new file the client asks for at a time
+const deltaBlocksPerRequest = 64
+
+type DeltaArgs struct {
+	Handle uint64
+	// Signature of the old file, only needed in the first request for an open file
+	Signature *Signature
+	// Range of the new file to describe
+	Offset, Size int64
+}
+
+type DeltaResponse struct {
+	Ops []DeltaOp
+	// where the next request should start, a copy can extend past the range
+	End int64
+}
+
+type SignatureArgs struct {
+	Handle    uint64
+	BlockSize int64
+	Offset    int64 // a multiple of the block size
+	Size      int64
+}
+
+// rollingChecksum is the rsync weak checksum
+type rollingChecksum struct {
+	a, b uint32
+	size uint32
+}
+
+func newRollingChecksum(data []byte) rollingChecksum {
+	rc := rollingChecksum{
+		size: uint32(len(data)),
+	}
+	for i, c := range data {
+		rc.a += uint32(c)
+		rc.b += uint32(len(data)-i) * uint32(c)
+	}
+	return rc
+}
+
+func (rc *rollingChecksum) Roll(out, in byte) {
+	rc.a += uint32(in) - uint32(out)
+	rc.b += rc.a - rc.size*uint32(out)
+}
+
+func (rc rollingChecksum) Sum() uint32 {
+	return rc.a&0xffff | rc.b<<16
+}
+
+// ComputeSignature reads a file sequentially and returns the signature of all
+// the blocks in it
+func ComputeSignature(r io.ReaderAt, size, blocksize int64) (Signature, error) {
+	blocks, err := computeBlockSignatures(r, size, blocksize, 0, size)
+	return Signature{
+		Size:      size,
+		BlockSize: blocksize,
+		Blocks:    blocks,
+	}, err
+}
+
+// computeBlockSignatures returns the signatures of the blocks starting in the
+// range from offset to end
+func computeBlockSignatures(r io.ReaderAt, size, blocksize, offset, end int64) ([]BlockSignature, error) {
+	if blocksize > maxChunkSize {
+		return nil, ErrChunkTooLarge
+	}
+	end = min(end, size)
+	// room for what a sync asks for at once, more just grows it
+	blocks := make([]BlockSignature, 0, max(0, min((end-offset+blocksize-1)/blocksize, checksumBlocksPerRequest)))
+	buf := make([]byte, blocksize)
+	for ; offset < end; offset += blocksize {
+		data := buf[:min(blocksize, size-offset)]
+		_, err := r.ReadAt(data, offset)
+		if err != nil {
+			return blocks, err
+		}
+		blocks = append(blocks, BlockSignature{
+			Weak:   newRollingChecksum(data).Sum(),
+			Strong: xxhash.Sum64(data),
+		})
+	}
+	return blocks, nil
+}
+
+// deltaIndex finds blocks of the old file by their weak checksum
+type deltaIndex struct {
+	blocksize int64
+	blocks    []BlockSignature
+	weak      map[uint32][]int
+
+	// a short last block can only match the end of the new file
+	tailsize int64
+	tail     BlockSignature
+}
+
+func newDeltaIndex(sig Signature) *deltaIndex {
+	di := &deltaIndex{
+		blocksize: sig.BlockSize,
+		blocks:    sig.Blocks,
+		weak:      make(map[uint32][]int, len(sig.Blocks)),
+	}
+	if len(di.blocks) > 0 && sig.Size%sig.BlockSize != 0 {
+		di.tailsize = sig.Size % sig.BlockSize
+		di.tail = di.blocks[len(di.blocks)-1]
+		di.blocks = di.blocks[:len(di.blocks)-1]
+	}
+	for i, block := range di.blocks {
+		di.weak[block.Weak] = append(di.weak[block.Weak], i)
+	}
+	return di
+}
+
+func (di *deltaIndex) find(weak uint32, data []byte) (int, bool) {
+	candidates, found := di.weak[weak]
+	if !found {
+		return 0, false
+	}
+	strong := xxhash.Sum64(data)
+	for _, candidate := range candidates {
+		if di.blocks[candidate].Strong == strong {
+			return candidate, true
+		}
+	}
+	return 0, false
+}
+
+// Delta describes the range [offset, offset+size) of the new file as
+// operations against the old file
+func (di *deltaIndex) Delta(r io.ReaderAt, filesize, offset, size int64) (DeltaResponse, error) {
+	var response DeltaResponse
+	if offset+size > filesize {
+		size = filesize - offset
+	}
+
+	// a match starting at the end of the range can go one block past it
+	bufsize := size + di.blocksize
+	if offset+bufsize > filesize {
+		bufsize = filesize - offset
+	}
+	buf := make([]byte, bufsize)
+	n, err := r.ReadAt(buf, offset)
+	if err != nil && (err != io.EOF || int64(n) != bufsize) {
+		return response, err
+	}
+
+	addliteral := func(data []byte) {
+		if len(data) == 0 {
+			return
+		}
+		response.Ops = append(response.Ops, DeltaOp{
+			Size: int64(len(data)),
+			Data: data,
+		})
+	}
+	addcopy := func(from, size int64) {
+		if len(response.Ops) > 0 {
+			last := &response.Ops[len(response.Ops)-1]
+			if last.Copy && last.CopyOffset+last.Size == from {
+				last.Size += size
+				return
+			}
+		}
+		response.Ops = append(response.Ops, DeltaOp{
+			Copy:       true,
+			CopyOffset: from,
+			Size:       size,
+		})
+	}
+
+	var pos, literal int64 // relative to offset
+	var rc rollingChecksum
+	rolling := false
+	for pos < size {
+		if pos+di.blocksize > bufsize {
+			// not enough left for a whole block, so the rest is either the
+			// short last block of the old file or literal
+			rest := buf[pos:]
+			if offset+bufsize == filesize && int64(len(rest)) == di.tailsize && xxhash.Sum64(rest) == di.tail.Strong {
+				addliteral(buf[literal:pos])
+				addcopy(int64(len(di.blocks))*di.blocksize, di.tailsize)
+				pos = bufsize
+				literal = pos
+			} else {
+				pos = size
+			}
+			break
+		}
+		if !rolling {
+			rc = newRollingChecksum(buf[pos : pos+di.blocksize])
+			rolling = true
+		}
+		if block, found := di.find(rc.Sum(), buf[pos:pos+di.blocksize]); found {
+			addliteral(buf[literal:pos])
+			addcopy(int64(block)*di.blocksize, di.blocksize)
+			pos += di.blocksize
+			literal = pos
+			rolling = false
+			continue
+		}
+		if pos+di.blocksize < bufsize {
+			rc.Roll(buf[pos], buf[pos+di.blocksize])
+		}
+		pos++
+		if pos-literal >= di.blocksize {
+			// keep literals the same size as blocks would be
+			addliteral(buf[literal:pos])
+			literal = pos
+		}
+	}
+	addliteral(buf[literal:pos])
+	response.End = offset + pos
+	return response, nil
+}
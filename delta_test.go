@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+// applyDelta builds the new file from the old one the way the client does,
+// asking for a range at a time, and returns how much was sent as literals
+func applyDelta(t *testing.T, old, new []byte, blocksize int64) ([]byte, int64) {
+	t.Helper()
+	sig, err := ComputeSignature(bytes.NewReader(old), int64(len(old)), blocksize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	di := newDeltaIndex(sig)
+	var result []byte
+	var literals int64
+	for offset := int64(0); offset < int64(len(new)); {
+		response, err := di.Delta(bytes.NewReader(new), int64(len(new)), offset, blocksize*deltaBlocksPerRequest/16)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response.End <= offset {
+			t.Fatalf("delta at %v didn't move forward", offset)
+		}
+		for _, op := range response.Ops {
+			if op.Copy {
+				if op.CopyOffset+op.Size > int64(len(old)) {
+					t.Fatalf("copy of %v bytes at %v is past the end of the old file", op.Size, op.CopyOffset)
+				}
+				result = append(result, old[op.CopyOffset:op.CopyOffset+op.Size]...)
+			} else {
+				if int64(len(op.Data)) != op.Size {
+					t.Fatalf("literal of %v bytes has %v bytes of data", op.Size, len(op.Data))
+				}
+				result = append(result, op.Data...)
+				literals += op.Size
+			}
+		}
+		offset = response.End
+	}
+	return result, literals
+}
+
+func TestDeltaRoundTrip(t *testing.T) {
+	const blocksize = 64
+	random := rand.New(rand.NewSource(1))
+	old := make([]byte, 100*blocksize+17) // with a short last block
+	random.Read(old)
+	splice := func(parts ...[]byte) []byte {
+		return bytes.Join(parts, nil)
+	}
+	inserted := []byte("some inserted bytes")
+
+	for _, test := range []struct {
+		name        string
+		new         []byte
+		maxliterals int64
+	}{
+		{"unchanged", old, 0},
+		{"insert at start", splice(inserted, old), int64(len(inserted))},
+		{"insert in middle", splice(old[:1000], inserted, old[1000:]), int64(len(inserted)) + 2*blocksize},
+		{"delete at start", old[5:], 2 * blocksize},
+		{"delete in middle", splice(old[:1000], old[1500:]), 2 * blocksize},
+		{"insert and delete", splice(inserted, old[:3000], old[3100:4000], inserted, old[4000:]), 2*int64(len(inserted)) + 4*blocksize},
+		{"append", splice(old, inserted), int64(len(inserted)) + 17},
+		{"truncate", old[:2000], 2 * blocksize},
+		{"short last block moved", splice(old[:1000], old[len(old)-17:]), 2 * blocksize},
+		{"all new", splice(inserted, inserted, inserted), 3 * int64(len(inserted))},
+		{"empty", nil, 0},
+	} {
+		result, literals := applyDelta(t, old, test.new, blocksize)
+		if !bytes.Equal(result, test.new) {
+			t.Errorf("%v: rebuilt file of %v bytes differs from the new one of %v bytes", test.name, len(result), len(test.new))
+			continue
+		}
+		if literals > test.maxliterals {
+			t.Errorf("%v: sent %v bytes of literals, expected at most %v", test.name, literals, test.maxliterals)
+		}
+	}
+
+	// nothing in common with an empty old file
+	result, literals := applyDelta(t, nil, old, blocksize)
+	if !bytes.Equal(result, old) || literals != int64(len(old)) {
+		t.Errorf("file from nothing rebuilt as %v bytes from %v bytes of literals", len(result), literals)
+	}
+}
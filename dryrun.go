@@ -0,0 +1,310 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/dustin/go-humanize"
+)
+
+type DryRunAction int
+
+const (
+	DryRunMkdir DryRunAction = iota
+	DryRunCreate
+	DryRunLink
+	DryRunTruncate
+	DryRunUpdate
+	DryRunAttributes
+	DryRunDelete
+	maxdryrunaction
+)
+
+var dryRunActionNames = [maxdryrunaction]string{
+	"mkdir",
+	"create",
+	"link",
+	"truncate",
+	"update",
+	"attributes",
+	"delete",
+}
+
+func (dra DryRunAction) String() string {
+	return dryRunActionNames[dra]
+}
+
+// DryRunTarget wraps a target and records what would have been done to it
+// instead of doing it. It keeps track of the entries it pretended to create or
+// remove, so the sync logic sees a consistent view of the target.
+type DryRunTarget struct {
+	target Target
+
+	lock      sync.Mutex
+	created   map[string]FileInfo
+	removed   map[string]struct{}
+	truncated map[string]int64
+	list      io.Writer
+
+	counters     [maxdryrunaction]uint64
+	updatedbytes uint64
+}
+
+func NewDryRunTarget(target Target, list io.Writer) *DryRunTarget {
+	return &DryRunTarget{
+		target:    target,
+		created:   make(map[string]FileInfo),
+		removed:   make(map[string]struct{}),
+		truncated: make(map[string]int64),
+		list:      list,
+	}
+}
+
+func (drt *DryRunTarget) record(action DryRunAction, path string, detail string) {
+	atomic.AddUint64(&drt.counters[action], 1)
+	line := fmt.Sprintf("%v %s", action, path)
+	if detail != "" {
+		line += " " + detail
+	}
+	logger.Debug().Msgf("Dry run: %v", line)
+	if drt.list != nil {
+		drt.lock.Lock()
+		fmt.Fprintln(drt.list, line)
+		drt.lock.Unlock()
+	}
+}
+
+func (drt *DryRunTarget) notFound(path string) error {
+	return &fs.PathError{Op: "dryrun", Path: path, Err: syscall.ENOENT}
+}
+
+func (drt *DryRunTarget) Stat(path string) (FileInfo, error) {
+	drt.lock.Lock()
+	fi, created := drt.created[path]
+	_, removed := drt.removed[path]
+	drt.lock.Unlock()
+	if created {
+		return fi, nil
+	}
+	if removed {
+		return FileInfo{}, drt.notFound(path)
+	}
+	return drt.target.Stat(path)
+}
+
+func (drt *DryRunTarget) ReadDir(path string) ([]DirEntry, error) {
+	drt.lock.Lock()
+	_, created := drt.created[path]
+	drt.lock.Unlock()
+	if created {
+		return nil, nil
+	}
+	return drt.target.ReadDir(path)
+}
+
+func (drt *DryRunTarget) pretendCreated(path string, fi FileInfo) {
+	// inode numbers of things we didn't create can't match anything
+	fi.Name = path
+	fi.Inode = 0
+	fi.Dev = 0
+	drt.lock.Lock()
+	drt.created[path] = fi
+	delete(drt.removed, path)
+	drt.lock.Unlock()
+}
+
+func (drt *DryRunTarget) Mkdir(path string) error {
+	drt.pretendCreated(path, FileInfo{
+		Mode:  fs.ModeDir | 0755,
+		IsDir: true,
+	})
+	drt.record(DryRunMkdir, path, "")
+	return nil
+}
+
+func (drt *DryRunTarget) Create(path string, fi FileInfo) error {
+	drt.pretendCreated(path, fi)
+	drt.record(DryRunCreate, path, fi.Mode.String())
+	return nil
+}
+
+func (drt *DryRunTarget) Link(oldpath, newpath string) error {
+	fi, err := drt.Stat(oldpath)
+	if err != nil {
+		return err
+	}
+	drt.pretendCreated(newpath, fi)
+	drt.record(DryRunLink, newpath, "=> "+oldpath)
+	return nil
+}
+
+func (drt *DryRunTarget) Truncate(path string, size int64) error {
+	drt.lock.Lock()
+	drt.truncated[path] = size
+	drt.lock.Unlock()
+	drt.record(DryRunTruncate, path, fmt.Sprintf("to %v bytes", size))
+	return nil
+}
+
+func (drt *DryRunTarget) remove(path string) {
+	drt.lock.Lock()
+	delete(drt.created, path)
+	delete(drt.truncated, path)
+	drt.removed[path] = struct{}{}
+	drt.lock.Unlock()
+	drt.record(DryRunDelete, path, "")
+}
+
+func (drt *DryRunTarget) Remove(path string) error {
+	drt.remove(path)
+	return nil
+}
+
+func (drt *DryRunTarget) RemoveAll(path string) error {
+	drt.remove(path)
+	return nil
+}
+
+func (drt *DryRunTarget) OpenFile(path string, mode fs.FileMode) (TargetFile, error) {
+	drt.lock.Lock()
+	_, created := drt.created[path]
+	truncatedsize, truncated := drt.truncated[path]
+	drt.lock.Unlock()
+
+	drf := &dryRunFile{
+		drt:  drt,
+		path: path,
+	}
+	if created {
+		// nothing there to compare with
+		return drf, nil
+	}
+	// only read from, so it works on a target that can't be written to
+	tf, err := drt.target.OpenRead(path)
+	if err != nil {
+		return nil, err
+	}
+	drf.tf = tf
+	drf.size = tf.Size()
+	if truncated && truncatedsize < drf.size {
+		drf.size = truncatedsize
+	}
+	return drf, nil
+}
+
+func (drt *DryRunTarget) OpenRead(path string) (TargetFile, error) {
+	return drt.OpenFile(path, 0)
+}
+
+func (drt *DryRunTarget) ApplyChanges(path string, current, wanted FileInfo, o CompareOptions) error {
+	drt.record(DryRunAttributes, path, "")
+	return nil
+}
+
+func (drt *DryRunTarget) CreateTemp(path string) (string, error) {
+	temppath := path + ".fastsync"
+	drt.pretendCreated(temppath, FileInfo{})
+	return temppath, nil
+}
+
+func (drt *DryRunTarget) Rename(oldpath, newpath string) error {
+	fi, err := drt.Stat(oldpath)
+	if err != nil {
+		return err
+	}
+	drt.lock.Lock()
+	delete(drt.created, oldpath)
+	drt.removed[oldpath] = struct{}{}
+	drt.lock.Unlock()
+	drt.pretendCreated(newpath, fi)
+	return nil
+}
+
+func (drt *DryRunTarget) Hash(path, algorithm string) (string, error) {
+	drt.lock.Lock()
+	_, created := drt.created[path]
+	_, removed := drt.removed[path]
+	drt.lock.Unlock()
+	if created || removed {
+		return "", drt.notFound(path)
+	}
+	return drt.target.Hash(path, algorithm)
+}
+
+func (drt *DryRunTarget) LookupID(name string, group bool) (uint32, error) {
+	return drt.target.LookupID(name, group)
+}
+
+func (drt *DryRunTarget) Summary() string {
+	var parts []string
+	for action := DryRunAction(0); action < maxdryrunaction; action++ {
+		parts = append(parts, fmt.Sprintf("%v %v", action, atomic.LoadUint64(&drt.counters[action])))
+	}
+	return fmt.Sprintf("Dry run would do: %v - transferring up to %v", strings.Join(parts, ", "), humanize.Bytes(atomic.LoadUint64(&drt.updatedbytes)))
+}
+
+// dryRunFile reads from the real file (if any) for block comparisons, and
+// counts the writes
+type dryRunFile struct {
+	drt        *DryRunTarget
+	tf         TargetFile
+	path       string
+	size       int64
+	wouldwrite int64
+}
+
+func (drf *dryRunFile) Size() int64 {
+	return drf.size
+}
+
+func (drf *dryRunFile) ChecksumRange(offset, size, blocksize int64) ([]uint64, error) {
+	if drf.tf == nil || offset+size > drf.size {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return drf.tf.ChecksumRange(offset, size, blocksize)
+}
+
+// Skip records that a block would have been written without needing the data
+func (drf *dryRunFile) Skip(size int64) {
+	drf.wouldwrite += size
+}
+
+func (drf *dryRunFile) WriteAt(data []byte, offset int64) (int, error) {
+	drf.wouldwrite += int64(len(data))
+	return len(data), nil
+}
+
+func (drf *dryRunFile) CopyChunk(src TargetFile, srcoffset, offset, size int64) error {
+	return nil
+}
+
+func (drf *dryRunFile) Signature(blocksize int64) (Signature, error) {
+	if drf.tf == nil {
+		return Signature{BlockSize: blocksize}, nil
+	}
+	return drf.tf.Signature(blocksize)
+}
+
+func (drf *dryRunFile) PunchHole(offset, size int64) error {
+	return nil
+}
+
+func (drf *dryRunFile) Sync() error {
+	return nil
+}
+
+func (drf *dryRunFile) Close() error {
+	if drf.wouldwrite > 0 {
+		atomic.AddUint64(&drf.drt.updatedbytes, uint64(drf.wouldwrite))
+		drf.drt.record(DryRunUpdate, drf.path, fmt.Sprintf("%v bytes", drf.wouldwrite))
+	}
+	if drf.tf != nil {
+		return drf.tf.Close()
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDryRunReadOnlyServer(t *testing.T) {
+	source, target := t.TempDir(), t.TempDir()
+	data := bytes.Repeat([]byte("0123456789"), 100000)
+	if err := os.WriteFile(filepath.Join(target, "file"), data, 0444); err != nil {
+		t.Fatal(err)
+	}
+	data[500000] = 'X'
+	if err := os.WriteFile(filepath.Join(source, "file"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(filepath.Join(source, "file"), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewClient()
+	if err := c.UseServer(LocalHello(false, CompareOptions{}), true); err != ErrReadOnly {
+		t.Errorf("pushing to a read only server gave %v", err)
+	}
+
+	for _, test := range []struct {
+		options func(c *Client)
+		partial bool // only the changed block would be sent
+	}{
+		{func(c *Client) {}, false},
+		{func(c *Client) { c.AlwaysChecksum = true }, true},
+		{func(c *Client) { c.Delta = true }, true},
+	} {
+		c := NewClient()
+		c.ParallelFile, c.ParallelDir = 2, 2
+		c.DryRun = true
+		test.options(c)
+		if err := c.UseServer(LocalHello(false, CompareOptions{}), true); err != nil {
+			t.Fatalf("dry run can't push to a read only server: %v", err)
+		}
+		pool := &ConnectionPool{clients: []*RPCClient{pipeClient(t, target, true, 0, time.Second)}}
+		if err := c.Run(NewLocalSource(source), NewRemoteTarget(pool)); err != nil {
+			t.Fatal(err)
+		}
+		if updates := c.dryrun.counters[DryRunUpdate]; updates != 1 {
+			t.Errorf("dry run would update %v files, expected 1", updates)
+		}
+		if updated := c.dryrun.updatedbytes; test.partial && (updated == 0 || updated >= uint64(len(data))) {
+			t.Errorf("dry run would transfer %v bytes, expected just the changed block", updated)
+		}
+	}
+}
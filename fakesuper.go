@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+
+	"github.com/pkg/xattr"
+)
+
+// In fake super mode ownership, the full mode and device numbers are kept in
+// an extended attribute instead of being applied, so a user without root can
+// keep everything needed to restore the files. Devices, FIFOs and sockets
+// become empty regular files with the attribute. When reading, the attribute
+// is used instead of what the filesystem says, so serving the files again in
+// fake super mode gives back what was stored. It's turned on with
+// CompareOptions.FakeSuper.
+
+// the attribute holds the st_mode in octal, the device number, the uid:gid
+// and the owner:group names if they were known, like "20660 2049 0:6 root:disk"
+const fakeSuperXattr = "user.fastsync.stat"
+
+// file type bits of a unix st_mode, which are the same everywhere
+const (
+	unixTypeMask = 0170000
+	unixSocket   = 0140000
+	unixSymlink  = 0120000
+	unixRegular  = 0100000
+	unixBlock    = 0060000
+	unixDir      = 0040000
+	unixChar     = 0020000
+	unixFIFO     = 0010000
+	unixSetuid   = 04000
+	unixSetgid   = 02000
+	unixSticky   = 01000
+)
+
+// unixMode returns the st_mode of an entry from its Go mode
+func unixMode(mode fs.FileMode) uint32 {
+	m := uint32(mode.Perm())
+	switch {
+	case mode&fs.ModeDir != 0:
+		m |= unixDir
+	case mode&fs.ModeSymlink != 0:
+		m |= unixSymlink
+	case mode&fs.ModeCharDevice != 0:
+		m |= unixChar
+	case mode&fs.ModeDevice != 0:
+		m |= unixBlock
+	case mode&fs.ModeNamedPipe != 0:
+		m |= unixFIFO
+	case mode&fs.ModeSocket != 0:
+		m |= unixSocket
+	default:
+		m |= unixRegular
+	}
+	if mode&fs.ModeSetuid != 0 {
+		m |= unixSetuid
+	}
+	if mode&fs.ModeSetgid != 0 {
+		m |= unixSetgid
+	}
+	if mode&fs.ModeSticky != 0 {
+		m |= unixSticky
+	}
+	return m
+}
+
+// goMode returns the Go mode for a st_mode
+func goMode(m uint32) fs.FileMode {
+	mode := fs.FileMode(m) & fs.ModePerm
+	switch m & unixTypeMask {
+	case unixDir:
+		mode |= fs.ModeDir
+	case unixSymlink:
+		mode |= fs.ModeSymlink
+	case unixChar:
+		mode |= fs.ModeDevice | fs.ModeCharDevice
+	case unixBlock:
+		mode |= fs.ModeDevice
+	case unixFIFO:
+		mode |= fs.ModeNamedPipe
+	case unixSocket:
+		mode |= fs.ModeSocket
+	}
+	if m&unixSetuid != 0 {
+		mode |= fs.ModeSetuid
+	}
+	if m&unixSetgid != 0 {
+		mode |= fs.ModeSetgid
+	}
+	if m&unixSticky != 0 {
+		mode |= fs.ModeSticky
+	}
+	return mode
+}
+
+// fakeSuperSpecial is true for entries that are stored as placeholder files
+func fakeSuperSpecial(mode fs.FileMode) bool {
+	return mode&(fs.ModeDevice|fs.ModeNamedPipe|fs.ModeSocket) != 0
+}
+
+// readFakeSuper replaces what the filesystem says with the stored attribute,
+// and hides the attribute
+func (fi *FileInfo) readFakeSuper() {
+	value, found := fi.Xattrs[fakeSuperXattr]
+	if !found {
+		return
+	}
+	delete(fi.Xattrs, fakeSuperXattr)
+	var mode uint32
+	var rdev uint64
+	var owner, group uint32
+	fields := strings.Fields(string(value))
+	_, err := fmt.Sscanf(strings.Join(fields[:min(len(fields), 3)], " "), "%o %d %d:%d", &mode, &rdev, &owner, &group)
+	if err != nil {
+		logger.Warn().Msgf("Ignoring invalid %v attribute on %s: %v", fakeSuperXattr, fi.Name, err)
+		return
+	}
+	fi.Mode = goMode(mode)
+	fi.Permissions = mode
+	fi.Rdev = rdev
+	fi.Owner = owner
+	fi.Group = group
+	// the names on this machine have nothing to do with the stored ids
+	fi.OwnerName, fi.GroupName = "", ""
+	if len(fields) > 3 {
+		fi.OwnerName, fi.GroupName, _ = strings.Cut(fields[3], ":")
+	}
+}
+
+// writeFakeSuper stores the owner, mode and device of fi2 on the entry, and
+// gives it permissions that let us read it back
+func (fi FileInfo) writeFakeSuper(fi2 FileInfo) error {
+	value := fmt.Sprintf("%o %d %d:%d", unixMode(fi2.Mode), fi2.Rdev, fi2.Owner, fi2.Group)
+	if fi2.OwnerName != "" || fi2.GroupName != "" {
+		value += " " + fi2.OwnerName + ":" + fi2.GroupName
+	}
+	err := xattr.LSet(fi.Name, fakeSuperXattr, []byte(value))
+	if err != nil {
+		return err
+	}
+	perm := fi2.Mode.Perm() | 0600
+	if fi2.Mode.IsDir() {
+		perm |= 0700
+	}
+	return noFollow(fi.Name, func(path string) error {
+		return os.Chmod(path, perm)
+	})
+}
+
+// createFakeSuper makes a placeholder file for a device, FIFO or socket
+func (fi FileInfo) createFakeSuper(fi2 FileInfo) error {
+	f, err := os.OpenFile(fi.Name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return fi.writeFakeSuper(fi2)
+}
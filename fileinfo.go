@@ -3,6 +3,7 @@ package main
 import (
 	"errors"
 	"io/fs"
+	"maps"
 	"os"
 	"slices"
 	"syscall"
@@ -30,21 +31,31 @@ type FileInfo struct {
 	Inode, Nlink uint64
 	Dev, Rdev    uint64
 	LinkTo       string
+	Sparse       bool // has less space allocated than its size, so it has holes
 
-	Atim syscall.Timespec
-	Mtim syscall.Timespec
-	Ctim syscall.Timespec
+	// names of the owner and group where the entry is, for mapping them to
+	// the ids they have on the other side
+	OwnerName, GroupName string
+
+	Flags uint32 // Linux inode flags like immutable, only with --inode-flags
+
+	Atim  syscall.Timespec
+	Mtim  syscall.Timespec
+	Ctim  syscall.Timespec
+	Btime syscall.Timespec // birth time, zero if unknown
 }
 
-func PathToFileInfo(absolutepath string) (FileInfo, error) {
+func PathToFileInfo(absolutepath string, o CompareOptions) (FileInfo, error) {
 	fi, err := os.Lstat(absolutepath)
 	if err != nil {
 		return FileInfo{}, err
 	}
-	return InfoToFileInfo(fi, absolutepath)
+	return InfoToFileInfo(fi, absolutepath, o)
 }
 
-func InfoToFileInfo(info os.FileInfo, absolutepath string) (FileInfo, error) {
+// InfoToFileInfo reads everything about an entry, and also the inode flags
+// and fake super attribute if the options say so
+func InfoToFileInfo(info os.FileInfo, absolutepath string, o CompareOptions) (FileInfo, error) {
 	fi := FileInfo{
 		Name:  absolutepath,
 		Mode:  info.Mode(),
@@ -78,11 +89,17 @@ func InfoToFileInfo(info os.FileInfo, absolutepath string) (FileInfo, error) {
 	}
 
 	if info.Mode()&os.ModeSymlink == 0 {
-		acl, err := acl.Get(absolutepath)
+		var entryacl acl.ACL
+		// reading the ACL follows symlinks
+		err := noFollow(absolutepath, func(path string) error {
+			var err error
+			entryacl, err = acl.Get(path)
+			return err
+		})
 		if err != nil && err.Error() != "operation not supported" {
 			logger.Warn().Msgf("Failed to get ACL for file %v: %v", fi.Name, err)
 		}
-		fi.ACL = acl
+		fi.ACL = entryacl
 
 		if xattr.XATTR_SUPPORTED {
 			xattrs, err := xattr.LList(absolutepath)
@@ -101,18 +118,162 @@ func InfoToFileInfo(info os.FileInfo, absolutepath string) (FileInfo, error) {
 	}
 
 	err := fi.extractNativeInfo(info)
+	if o.InodeFlags {
+		fi.readInodeFlags(absolutepath)
+	}
+	if o.FakeSuper {
+		fi.readFakeSuper()
+	}
 	return fi, err
 }
 
-func (fi FileInfo) Compare(fi2 FileInfo) (differences []string, requiresDelete bool) {
-	panic("not implemented")
-	return nil, false
+// FileDiff is the result of comparing a target entry with the wanted source entry
+type FileDiff struct {
+	Type   bool // different kind of entry, must be deleted and recreated
+	Link   bool // symlink points somewhere else, must be recreated
+	Device bool // device numbers differ, must be recreated
+
+	Content bool // size or modification time differ, so data must be verified
+
+	Size        bool
+	Mtime       bool
+	Permissions bool
+	Owner       bool
+	Group       bool
+	ACL         bool
+	Xattrs      bool
+	Flags       bool
 }
 
-func (fi FileInfo) ApplyChanges(fi2 FileInfo) error {
+// RequiresDelete is true if the entry can't be updated in place
+func (fd FileDiff) RequiresDelete() bool {
+	return fd.Type || fd.Link || fd.Device
+}
+
+// Metadata is true if there are attributes to apply
+func (fd FileDiff) Metadata() bool {
+	return fd.Size || fd.Mtime || fd.Permissions || fd.Owner || fd.Group || fd.ACL || fd.Xattrs || fd.Flags
+}
+
+func (fd FileDiff) Equal() bool {
+	return !fd.RequiresDelete() && !fd.Content && !fd.Metadata()
+}
+
+// Differences lists the names of the differing attributes
+func (fd FileDiff) Differences() []string {
+	var result []string
+	for _, d := range []struct {
+		differs bool
+		name    string
+	}{
+		{fd.Type, "type"},
+		{fd.Link, "link"},
+		{fd.Device, "device"},
+		{fd.Size, "size"},
+		{fd.Mtime, "mtime"},
+		{fd.Permissions, "permissions"},
+		{fd.Owner, "owner"},
+		{fd.Group, "group"},
+		{fd.ACL, "acl"},
+		{fd.Xattrs, "xattrs"},
+		{fd.Flags, "flags"},
+	} {
+		if d.differs {
+			result = append(result, d.name)
+		}
+	}
+	return result
+}
+
+const permissionBits = fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky
+
+// CompareOptions are the attributes that are only read, compared and applied
+// when asked for, so the result of Compare only depends on what's passed to it
+type CompareOptions struct {
+	InodeFlags bool // Linux inode flags like immutable and append-only
+	// owner, mode and devices are kept in an extended attribute on this side,
+	// so the server always uses its own setting
+	FakeSuper bool
+}
+
+// Compare returns what differs between fi and the wanted state fi2
+func (fi FileInfo) Compare(fi2 FileInfo, o CompareOptions) FileDiff {
+	var fd FileDiff
+
+	// the attributes are compared even for type changes, so the result can be
+	// used when applying attributes to the recreated entry
+	fd.Type = fi.Mode.Type() != fi2.Mode.Type()
+
+	issymlink := fi2.Mode&fs.ModeSymlink != 0
+	isdevice := fi2.Mode&fs.ModeDevice != 0
+
+	fd.Link = issymlink && fi.LinkTo != fi2.LinkTo
+	fd.Device = isdevice && fi.Rdev != fi2.Rdev
+
+	fd.Size = fi2.Mode.IsRegular() && fi.Size != fi2.Size
+	fd.Mtime = fi.Mtim.Nano() != fi2.Mtim.Nano()
+	fd.Content = fi2.Mode.IsRegular() && (fd.Size || fd.Mtime)
+
+	fd.Permissions = !issymlink && fi.Mode&permissionBits != fi2.Mode&permissionBits
+	fd.Owner = fi.Owner != fi2.Owner
+	fd.Group = fi.Group != fi2.Group
+
+	if !issymlink {
+		fd.ACL = len(fi2.ACL) > 0 && !slices.Equal(extendedACL(fi.ACL), extendedACL(fi2.ACL))
+		fd.Xattrs = fi2.Xattrs != nil && !maps.EqualFunc(fi.Xattrs, fi2.Xattrs, slices.Equal[[]byte])
+	}
+
+	fd.Flags = o.InodeFlags && fi.Flags != fi2.Flags
+
+	return fd
+}
+
+// extendedACL returns the ACL entries that are not just a mirror of the
+// permission bits
+func extendedACL(a acl.ACL) acl.ACL {
+	var result acl.ACL
+	for _, entry := range a {
+		switch entry.Tag {
+		case acl.TagUserObj, acl.TagGroupObj, acl.TagOther:
+			continue
+		}
+		result = append(result, entry)
+	}
+	return result
+}
+
+// ApplyChanges changes the attributes of fi that differ from fi2
+func (fi FileInfo) ApplyChanges(fi2 FileInfo, o CompareOptions) error {
 	logger.Debug().Msgf("Updating metadata for %s", fi.Name)
 
-	if fi.Owner != fi2.Owner || fi.Group != fi2.Group {
+	diff := fi.Compare(fi2, o)
+
+	if o.InodeFlags && (diff.Flags || fi.Flags&inodeFlagsLocked != 0 && diff.Metadata()) {
+		// immutable and append-only entries can't be changed, so the flags
+		// come off first and go on again last
+		if fi.Flags&inodeFlagsLocked != 0 {
+			err := setInodeFlags(fi.Name, fi.Flags&^inodeFlagsLocked)
+			if err != nil {
+				logger.Error().Msgf("Error clearing flags for %s: %v", fi.Name, err)
+			}
+		}
+		defer func() {
+			err := setInodeFlags(fi.Name, fi2.Flags)
+			if err != nil {
+				logger.Error().Msgf("Error setting flags for %s: %v", fi.Name, err)
+			}
+		}()
+	}
+
+	if o.FakeSuper {
+		// symlinks can't have user attributes, so they're left as they are
+		if (diff.Owner || diff.Group || diff.Permissions) && fi2.Mode&fs.ModeSymlink == 0 {
+			err := fi.writeFakeSuper(fi2)
+			if err != nil {
+				logger.Error().Msgf("Error storing owner and mode for %s: %v", fi.Name, err)
+			}
+		}
+	} else if diff.Owner || diff.Group {
 		err := fi.Chown(fi2)
 		if err != nil && err != ErrNotSupportedByPlatform {
 			logger.Error().Msgf("Error changing owner for %s: %v", fi.Name, err)
@@ -120,28 +281,24 @@ func (fi FileInfo) ApplyChanges(fi2 FileInfo) error {
 	}
 
 	if fi2.Mode&fs.ModeSymlink == 0 {
-		if uint32(fi.Mode)&^uint32(os.ModePerm) != fi2.Permissions&^uint32(os.ModePerm) {
+		if diff.Permissions && !o.FakeSuper {
 			err := fi.Chmod(fi2)
-			if err != nil {
+			if err != nil && err != ErrNotSupportedByPlatform {
 				logger.Error().Msgf("Error changing mode for %s: %v", fi.Name, err)
 			}
 		}
 
-		if len(fi2.ACL) > 0 {
-			currentacl, err := acl.Get(fi.Name)
+		// chmod can change the ACL mask, so reapply extended ACLs then as well
+		if diff.ACL || (diff.Permissions && len(extendedACL(fi2.ACL)) > 0) {
+			err := noFollow(fi.Name, func(path string) error {
+				return acl.Set(path, fi2.ACL)
+			})
 			if err != nil {
-				logger.Error().Msgf("Error getting ACL for %s: %v", fi.Name, err)
-			} else {
-				if !slices.Equal(currentacl, fi2.ACL) {
-					err = acl.Set(fi.Name, fi2.ACL)
-					if err != nil {
-						logger.Error().Msgf("Error setting ACL %+v (was %+v) for %s: %v", fi2.ACL, currentacl, fi.Name, err)
-					}
-				}
+				logger.Error().Msgf("Error setting ACL %+v (was %+v) for %s: %v", fi2.ACL, fi.ACL, fi.Name, err)
 			}
 		}
 
-		if xattr.XATTR_SUPPORTED && fi2.Xattrs != nil {
+		if xattr.XATTR_SUPPORTED && diff.Xattrs {
 			if fi.Xattrs != nil {
 				// delete attribute that do not exist in fi2
 				for attr := range fi.Xattrs {
@@ -173,7 +330,7 @@ func (fi FileInfo) ApplyChanges(fi2 FileInfo) error {
 		}
 	}
 
-	if fi.Mtim != fi2.Mtim {
+	if diff.Mtime {
 		err := fi.SetTimestamps(fi2)
 		if err != nil {
 			logger.Error().Msgf("Error changing times for %s: %v", fi.Name, err)
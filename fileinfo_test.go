@@ -0,0 +1,178 @@
+package main
+
+import (
+	"io/fs"
+	"slices"
+	"syscall"
+	"testing"
+
+	"github.com/joshlf/go-acl"
+)
+
+// mirrorACL is the ACL every entry has, which just mirrors the permissions
+var mirrorACL = acl.ACL{
+	{Tag: acl.TagUserObj, Perms: 6},
+	{Tag: acl.TagGroupObj, Perms: 4},
+	{Tag: acl.TagOther, Perms: 4},
+}
+
+func testFile() FileInfo {
+	return FileInfo{
+		Name:        "/dir/file",
+		Mode:        0644,
+		Size:        1000,
+		Permissions: 0100644,
+		ACL:         mirrorACL,
+		Xattrs:      map[string][]byte{"user.comment": []byte("hello")},
+		Owner:       1000,
+		Group:       100,
+		Flags:       inodeFlagNodump,
+		Mtim:        syscall.Timespec{Sec: 1700000000, Nsec: 5},
+	}
+}
+
+func TestCompare(t *testing.T) {
+	tests := []struct {
+		name    string
+		current func(fi *FileInfo)
+		wanted  func(fi *FileInfo)
+		options CompareOptions
+		diff    FileDiff
+	}{
+		{
+			name: "equal",
+		},
+		{
+			name:   "type",
+			wanted: func(fi *FileInfo) { fi.Mode = fs.ModeDir | 0644; fi.IsDir = true },
+			diff:   FileDiff{Type: true},
+		},
+		{
+			name:    "link",
+			current: func(fi *FileInfo) { fi.Mode = fs.ModeSymlink | 0777; fi.LinkTo = "old" },
+			wanted:  func(fi *FileInfo) { fi.Mode = fs.ModeSymlink | 0777; fi.LinkTo = "new" },
+			diff:    FileDiff{Link: true},
+		},
+		{
+			name:    "device",
+			current: func(fi *FileInfo) { fi.Mode = fs.ModeDevice | fs.ModeCharDevice | 0644; fi.Rdev = 1 },
+			wanted:  func(fi *FileInfo) { fi.Mode = fs.ModeDevice | fs.ModeCharDevice | 0644; fi.Rdev = 2 },
+			diff:    FileDiff{Device: true},
+		},
+		{
+			name:   "content",
+			wanted: func(fi *FileInfo) { fi.Mtim.Nsec++ },
+			diff:   FileDiff{Content: true, Mtime: true},
+		},
+		{
+			name:   "size",
+			wanted: func(fi *FileInfo) { fi.Size++ },
+			diff:   FileDiff{Content: true, Size: true},
+		},
+		{
+			name:    "mtime",
+			current: func(fi *FileInfo) { fi.Mode = fs.ModeDir | 0755; fi.IsDir = true },
+			wanted:  func(fi *FileInfo) { fi.Mode = fs.ModeDir | 0755; fi.IsDir = true; fi.Mtim.Sec++ },
+			diff:    FileDiff{Mtime: true},
+		},
+		{
+			name:   "permissions",
+			wanted: func(fi *FileInfo) { fi.Mode = 0600 | fs.ModeSetuid },
+			diff:   FileDiff{Permissions: true},
+		},
+		{
+			name:    "permissions of symlinks",
+			current: func(fi *FileInfo) { fi.Mode = fs.ModeSymlink | 0777 },
+			wanted:  func(fi *FileInfo) { fi.Mode = fs.ModeSymlink | 0700 },
+		},
+		{
+			name:   "owner",
+			wanted: func(fi *FileInfo) { fi.Owner = 0 },
+			diff:   FileDiff{Owner: true},
+		},
+		{
+			name:   "group",
+			wanted: func(fi *FileInfo) { fi.Group = 0 },
+			diff:   FileDiff{Group: true},
+		},
+		{
+			name: "acl",
+			wanted: func(fi *FileInfo) {
+				fi.ACL = append(slices.Clone(mirrorACL), acl.Entry{Tag: acl.TagUser, Qualifier: "0", Perms: 7})
+			},
+			diff: FileDiff{ACL: true},
+		},
+		{
+			name:   "acl mirroring the permissions",
+			wanted: func(fi *FileInfo) { fi.ACL = acl.ACL{{Tag: acl.TagUserObj, Perms: 7}} },
+		},
+		{
+			name:   "xattrs",
+			wanted: func(fi *FileInfo) { fi.Xattrs = map[string][]byte{"user.comment": []byte("bye")} },
+			diff:   FileDiff{Xattrs: true},
+		},
+		{
+			name:   "xattrs not transferred",
+			wanted: func(fi *FileInfo) { fi.Xattrs = nil },
+		},
+		{
+			name:    "flags",
+			wanted:  func(fi *FileInfo) { fi.Flags = inodeFlagImmutable },
+			options: CompareOptions{InodeFlags: true},
+			diff:    FileDiff{Flags: true},
+		},
+		{
+			name:   "flags not asked for",
+			wanted: func(fi *FileInfo) { fi.Flags = inodeFlagImmutable },
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			current, wanted := testFile(), testFile()
+			if test.current != nil {
+				test.current(&current)
+			}
+			if test.current != nil && test.wanted == nil {
+				test.wanted = test.current
+			}
+			if test.wanted != nil {
+				test.wanted(&wanted)
+			}
+			diff := current.Compare(wanted, test.options)
+			if diff != test.diff {
+				t.Errorf("got %+v, expected %+v", diff, test.diff)
+			}
+		})
+	}
+}
+
+func TestFileDiff(t *testing.T) {
+	for _, test := range []struct {
+		diff           FileDiff
+		differences    []string
+		requiresdelete bool
+		metadata       bool
+	}{
+		{FileDiff{}, nil, false, false},
+		{FileDiff{Type: true}, []string{"type"}, true, false},
+		{FileDiff{Link: true}, []string{"link"}, true, false},
+		{FileDiff{Device: true}, []string{"device"}, true, false},
+		{FileDiff{Content: true, Size: true}, []string{"size"}, false, true},
+		{FileDiff{Mtime: true, Owner: true}, []string{"mtime", "owner"}, false, true},
+		{FileDiff{Permissions: true, Group: true, ACL: true}, []string{"permissions", "group", "acl"}, false, true},
+		{FileDiff{Xattrs: true, Flags: true}, []string{"xattrs", "flags"}, false, true},
+	} {
+		if got := test.diff.Differences(); !slices.Equal(got, test.differences) {
+			t.Errorf("%+v has differences %v, expected %v", test.diff, got, test.differences)
+		}
+		if got := test.diff.RequiresDelete(); got != test.requiresdelete {
+			t.Errorf("%+v RequiresDelete is %v", test.diff, got)
+		}
+		if got := test.diff.Metadata(); got != test.metadata {
+			t.Errorf("%+v Metadata is %v", test.diff, got)
+		}
+		if got := test.diff.Equal(); got != (test.differences == nil) {
+			t.Errorf("%+v Equal is %v", test.diff, got)
+		}
+	}
+}
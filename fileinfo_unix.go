@@ -11,7 +11,10 @@ import (
 	unix "golang.org/x/sys/unix"
 )
 
-func (fi FileInfo) Create(fi2 FileInfo) error {
+func (fi FileInfo) Create(fi2 FileInfo, o CompareOptions) error {
+	if o.FakeSuper && fakeSuperSpecial(fi2.Mode) {
+		return fi.createFakeSuper(fi2)
+	}
 	if fi2.Mode&fs.ModeDevice != 0 {
 		if fi2.Mode&fs.ModeCharDevice != 0 {
 			return mkNod(fi.Name, syscall.S_IFCHR, fi2.Rdev)
@@ -42,8 +45,10 @@ func (fi FileInfo) SetTimestamps(fi2 FileInfo) error {
 }
 
 func (fi FileInfo) Chmod(fi2 FileInfo) error {
-	return unix.Chmod(fi.Name, fi2.Permissions)
-	// return unix.Fchmodat(unix.AT_FDCWD, f.Name, fi2.Permissions, unix.AT_SYMLINK_NOFOLLOW)
+	// chmod follows symlinks, so make sure there isn't one there now
+	return noFollow(fi.Name, func(path string) error {
+		return unix.Chmod(path, fi2.Permissions)
+	})
 }
 
 func (fi *FileInfo) extractNativeInfo(fsfi fs.FileInfo) error {
@@ -54,7 +59,10 @@ func (fi *FileInfo) extractNativeInfo(fsfi fs.FileInfo) error {
 		fi.Rdev = uint64(stat.Rdev)
 		fi.Owner = stat.Uid
 		fi.Group = stat.Gid
+		fi.OwnerName = userName(stat.Uid)
+		fi.GroupName = groupName(stat.Gid)
 		fi.Permissions = uint32(stat.Mode)
+		fi.Sparse = fsfi.Mode().IsRegular() && int64(stat.Blocks)*512 < int64(stat.Size)
 
 		atim, mtim, ctim := getAMtime(*stat)
 		fi.Atim = atim
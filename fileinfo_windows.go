@@ -7,7 +7,7 @@ import (
 	"time"
 )
 
-func (f FileInfo) Create(remotefi FileInfo) error {
+func (f FileInfo) Create(remotefi FileInfo, o CompareOptions) error {
 	if remotefi.Mode&fs.ModeDevice != 0 {
 		if remotefi.Mode&fs.ModeCharDevice != 0 {
 			return ErrNotSupportedByPlatform
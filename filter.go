@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// FilterRule is a single rsync style include or exclude pattern:
+//
+//   - "*" matches anything except "/", "**" matches anything, "?" matches one
+//     character except "/", and [...] matches a character class
+//   - a leading "/" anchors the pattern to the root of the sync, otherwise it
+//     matches the end of the path (the name itself if there is no "/" in it)
+//   - a trailing "/" makes the rule only match directories
+type FilterRule struct {
+	Include bool
+	Pattern string
+	DirOnly bool
+
+	re *regexp.Regexp
+}
+
+func NewFilterRule(include bool, pattern string) (FilterRule, error) {
+	rule := FilterRule{
+		Include: include,
+		Pattern: pattern,
+	}
+	if len(pattern) > 1 && strings.HasSuffix(pattern, "/") {
+		rule.DirOnly = true
+		pattern = strings.TrimSuffix(pattern, "/")
+	}
+
+	var expr strings.Builder
+	if strings.HasPrefix(pattern, "/") {
+		expr.WriteString("^")
+	} else {
+		expr.WriteString("(^|/)")
+	}
+	for i := 0; i < len(pattern); i++ {
+		switch ch := pattern[i]; ch {
+		case '*':
+			if i+1 < len(pattern) && pattern[i+1] == '*' {
+				expr.WriteString(".*")
+				i++
+			} else {
+				expr.WriteString("[^/]*")
+			}
+		case '?':
+			expr.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				return rule, fmt.Errorf("unterminated character class in pattern %v", rule.Pattern)
+			}
+			class := pattern[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				// like the other wildcards it never matches a "/"
+				class = "^/" + class[1:]
+			}
+			expr.WriteString("[" + class + "]")
+			i += end + 1
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(ch)))
+		}
+	}
+	expr.WriteString("$")
+
+	re, err := regexp.Compile(expr.String())
+	if err != nil {
+		return rule, fmt.Errorf("invalid pattern %v: %v", rule.Pattern, err)
+	}
+	rule.re = re
+	return rule, nil
+}
+
+func (fr FilterRule) Match(path string, isdir bool) bool {
+	if fr.DirOnly && !isdir {
+		return false
+	}
+	return fr.re.MatchString(path)
+}
+
+// Filter is an ordered list of rules, where the first matching rule decides
+// if a path is included or excluded. Paths not matching any rule are included.
+type Filter struct {
+	rules []FilterRule
+}
+
+func (f *Filter) Add(include bool, pattern string) error {
+	rule, err := NewFilterRule(include, pattern)
+	if err != nil {
+		return err
+	}
+	f.rules = append(f.rules, rule)
+	return nil
+}
+
+// AddFromFile reads exclude patterns from a file, one per line. Blank lines and
+// lines starting with # or ; are ignored, and lines can be prefixed with "+ " or
+// "- " to make them include or exclude rules explicitly.
+func (f *Filter) AddFromFile(filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if strings.TrimSpace(line) == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		include := false
+		if strings.HasPrefix(line, "+ ") {
+			include = true
+			line = line[2:]
+		} else if strings.HasPrefix(line, "- ") {
+			line = line[2:]
+		}
+		err = f.Add(include, line)
+		if err != nil {
+			return fmt.Errorf("%v: %v", filename, err)
+		}
+	}
+	return scanner.Err()
+}
+
+func (f *Filter) Len() int {
+	if f == nil {
+		return 0
+	}
+	return len(f.rules)
+}
+
+// String lists the rules in order like they're written in a filter file
+func (f *Filter) String() string {
+	if f == nil {
+		return ""
+	}
+	var rules []string
+	for _, rule := range f.rules {
+		if rule.Include {
+			rules = append(rules, "+ "+rule.Pattern)
+		} else {
+			rules = append(rules, "- "+rule.Pattern)
+		}
+	}
+	return strings.Join(rules, "\n")
+}
+
+// Excluded checks a path relative to the root of the sync (starting with a
+// separator), which can use the separator of the platform
+func (f *Filter) Excluded(path string, isdir bool) bool {
+	if f == nil {
+		return false
+	}
+	path = filepath.ToSlash(path)
+	for _, rule := range f.rules {
+		if rule.Match(path, isdir) {
+			return !rule.Include
+		}
+	}
+	return false
+}
+
+// filterFlag is a command line flag that adds rules to a filter while the
+// command line is parsed, so rules from all the flags keep their order
+type filterFlag struct {
+	filter   *Filter
+	include  bool
+	fromfile bool
+}
+
+func (ff filterFlag) Set(value string) error {
+	if ff.fromfile {
+		return ff.filter.AddFromFile(value)
+	}
+	return ff.filter.Add(ff.include, value)
+}
+
+func (ff filterFlag) String() string {
+	return ""
+}
+
+func (ff filterFlag) Type() string {
+	if ff.fromfile {
+		return "file"
+	}
+	return "pattern"
+}
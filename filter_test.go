@@ -0,0 +1,177 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/pflag"
+)
+
+func TestFilterRules(t *testing.T) {
+	type check struct {
+		path     string
+		isdir    bool
+		excluded bool
+	}
+	for _, test := range []struct {
+		name   string
+		rules  []string // "+ " includes, "- " excludes
+		checks []check
+	}{
+		{"name anywhere", []string{"- *.tmp"}, []check{
+			{"/a.tmp", false, true},
+			{"/dir/sub/a.tmp", false, true},
+			{"/a.tmpx", false, false},
+			{"/dir.tmp/file", false, false},
+		}},
+		{"star stays in a name", []string{"- /dir/*.o"}, []check{
+			{"/dir/a.o", false, true},
+			{"/dir/sub/a.o", false, false},
+		}},
+		{"double star crosses directories", []string{"- /dir/**.o"}, []check{
+			{"/dir/a.o", false, true},
+			{"/dir/sub/deeper/a.o", false, true},
+			{"/other/a.o", false, false},
+		}},
+		{"double star in the middle", []string{"- /a/**/z"}, []check{
+			{"/a/b/z", false, true},
+			{"/a/b/c/z", false, true},
+			{"/b/a/c/z", false, false},
+		}},
+		{"anchored", []string{"- /build"}, []check{
+			{"/build", true, true},
+			{"/src/build", true, false},
+		}},
+		{"unanchored with a slash matches the end", []string{"- cache/data"}, []check{
+			{"/cache/data", false, true},
+			{"/home/user/cache/data", false, true},
+			{"/home/usercache/data", false, false},
+		}},
+		{"directory only", []string{"- logs/"}, []check{
+			{"/logs", true, true},
+			{"/var/logs", true, true},
+			{"/logs", false, false},
+		}},
+		{"question mark and classes", []string{"- file?.[ch]", "- [!a]*.bak"}, []check{
+			{"/file1.c", false, true},
+			{"/file12.c", false, false},
+			{"/file1.o", false, false},
+			{"/b.bak", false, true},
+			{"/a.bak", false, false},
+		}},
+		{"first match wins with include first", []string{"+ *.go", "- *"}, []check{
+			{"/main.go", false, false},
+			{"/readme.md", false, true},
+		}},
+		{"first match wins with exclude first", []string{"- *", "+ *.go"}, []check{
+			{"/main.go", false, true},
+		}},
+		{"include directories to reach files", []string{"+ */", "+ *.go", "- *"}, []check{
+			{"/src", true, false},
+			{"/src/main.go", false, false},
+			{"/src/readme.md", false, true},
+		}},
+		{"no rules", nil, []check{
+			{"/anything", false, false},
+		}},
+	} {
+		filter := &Filter{}
+		for _, rule := range test.rules {
+			if err := filter.Add(rule[0] == '+', rule[2:]); err != nil {
+				t.Fatalf("%v: %v", test.name, err)
+			}
+		}
+		for _, check := range test.checks {
+			if excluded := filter.Excluded(check.path, check.isdir); excluded != check.excluded {
+				t.Errorf("%v: %v (directory %v) excluded is %v, expected %v", test.name, check.path, check.isdir, excluded, check.excluded)
+			}
+		}
+	}
+}
+
+func TestFilterPlatformSeparator(t *testing.T) {
+	filter := &Filter{}
+	filter.Add(false, "/dir/*.tmp")
+	if !filter.Excluded(filepath.Join(string(filepath.Separator), "dir", "a.tmp"), false) {
+		t.Error("path joined with the platform separator isn't excluded")
+	}
+}
+
+func TestFilterFlagOrder(t *testing.T) {
+	rulesfile := filepath.Join(t.TempDir(), "rules")
+	err := os.WriteFile(rulesfile, []byte("# comment\n+ keep.log\n\n- *.log\n; other comment\n*.bak\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filter := &Filter{}
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	flags.Var(filterFlag{filter: filter, include: true}, "include", "")
+	flags.Var(filterFlag{filter: filter}, "exclude", "")
+	flags.Var(filterFlag{filter: filter, fromfile: true}, "exclude-from", "")
+	err = flags.Parse([]string{"--exclude", "/secret", "--include", "*.bak", "--exclude-from", rulesfile, "--include", "*.log"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "- /secret\n+ *.bak\n+ keep.log\n- *.log\n- *.bak\n+ *.log"
+	if filter.String() != expected {
+		t.Errorf("rules are\n%v\nexpected\n%v", filter, expected)
+	}
+	for path, excluded := range map[string]bool{
+		"/secret":   true,
+		"/a.bak":    false, // the include comes before the rule in the file
+		"/keep.log": false,
+		"/a.log":    true, // the rule in the file comes before the include
+	} {
+		if filter.Excluded(path, false) != excluded {
+			t.Errorf("%v excluded is %v, expected %v", path, !excluded, excluded)
+		}
+	}
+
+	if flags.Parse([]string{"--exclude", "[unterminated"}) == nil {
+		t.Error("invalid pattern was accepted")
+	}
+}
+
+func TestDeleteExcluded(t *testing.T) {
+	for _, deleteexcluded := range []bool{false, true} {
+		source, target := t.TempDir(), t.TempDir()
+		for _, name := range []string{"file", "a.tmp"} {
+			if err := os.WriteFile(filepath.Join(source, name), []byte(name), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, name := range []string{"extra", "extra.tmp", "a.tmp"} {
+			if err := os.WriteFile(filepath.Join(target, name), []byte("old"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		c := NewClient()
+		c.ParallelFile, c.ParallelDir = 2, 2
+		c.Delete = true
+		c.DeleteExcluded = deleteexcluded
+		c.Filter = &Filter{}
+		c.Filter.Add(false, "*.tmp")
+		if err := c.Run(NewLocalSource(source), NewLocalTarget(target)); err != nil {
+			t.Fatal(err)
+		}
+
+		for name, exists := range map[string]bool{
+			"file":      true,            // synced
+			"extra":     false,           // deleted as it's not on the source
+			"extra.tmp": !deleteexcluded, // excluded, so only deleted with delete excluded
+			"a.tmp":     !deleteexcluded, // excluded on the source too, so it's never synced
+		} {
+			_, err := os.Stat(filepath.Join(target, name))
+			if exists != (err == nil) {
+				t.Errorf("with delete excluded %v, %v exists is %v, expected %v", deleteexcluded, name, err == nil, exists)
+			}
+		}
+		if data, _ := os.ReadFile(filepath.Join(target, "a.tmp")); !deleteexcluded && string(data) != "old" {
+			t.Errorf("excluded a.tmp was changed to %q", data)
+		}
+	}
+}
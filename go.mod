@@ -12,11 +12,14 @@ require (
 	github.com/rs/zerolog v1.33.0
 	github.com/spf13/pflag v1.0.5
 	github.com/ugorji/go/codec v1.2.12
+	github.com/zeebo/blake3 v0.2.3
+	github.com/zeebo/xxh3 v1.0.2
 	golang.org/x/sys v0.20.0
 )
 
 require (
 	github.com/joshlf/testutil v0.0.0-20170608050642-b5d8aa79d93d // indirect
+	github.com/klauspost/cpuid/v2 v2.0.12 // indirect
 	github.com/mattn/go-colorable v0.1.13 // indirect
 	github.com/mattn/go-isatty v0.0.20 // indirect
 	github.com/peterrk/slices v1.0.0 // indirect
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// syncWithChangeLog syncs source to target and returns what the changelog says
+// was done
+func syncWithChangeLog(t *testing.T, source, target string) []ChangeEntry {
+	t.Helper()
+	return syncWithOptions(t, NewLocalSource(source), NewLocalTarget(target), CompareOptions{})
+}
+
+func syncWithOptions(t *testing.T, source *LocalSource, target *LocalTarget, options CompareOptions) []ChangeEntry {
+	t.Helper()
+	logname := filepath.Join(t.TempDir(), "changelog")
+	changelog, err := NewChangeLog(logname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewClient()
+	c.ParallelFile, c.ParallelDir = 2, 2
+	c.ChangeLog = changelog
+	c.CompareOptions = options
+	if err := c.Run(source, target); err != nil {
+		t.Fatal(err)
+	}
+	changelog.Close()
+
+	f, err := os.Open(logname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var entries []ChangeEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry ChangeEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestHardlinkedTwice(t *testing.T) {
+	// the target inode of a hardlinked file has to be remembered the first
+	// time it's seen, otherwise links that are already right are broken up
+	// and linked again on every sync
+	source, target := t.TempDir(), t.TempDir()
+	if err := os.WriteFile(filepath.Join(source, "a"), []byte("linked content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(filepath.Join(source, "a"), filepath.Join(source, "b")); err != nil {
+		t.Fatal(err)
+	}
+
+	syncWithChangeLog(t, source, target)
+	a, err := os.Stat(filepath.Join(target, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.Stat(filepath.Join(target, "b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(a, b) {
+		t.Fatal("a and b aren't linked on the target")
+	}
+
+	for _, entry := range syncWithChangeLog(t, source, target) {
+		t.Errorf("second sync did %v to %v (%v)", entry.Action, entry.Path, entry.Differences)
+	}
+}
+
+func TestHardlinkedSeparateCopies(t *testing.T) {
+	source, target := t.TempDir(), t.TempDir()
+	for _, dir := range []string{source, target} {
+		if err := os.WriteFile(filepath.Join(dir, "a"), []byte("linked content"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Link(filepath.Join(source, "a"), filepath.Join(source, "b")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(target, "b"), []byte("linked content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	syncWithChangeLog(t, source, target)
+	a, err := os.Stat(filepath.Join(target, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.Stat(filepath.Join(target, "b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(a, b) {
+		t.Error("separate copies of a and b weren't linked on the target")
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"strings"
+
+	"github.com/pkg/xattr"
+)
+
+// ProtocolVersion changes whenever RPC arguments or replies change in a way
+// that older builds can't handle, MinProtocolVersion is the oldest we still talk to
+const (
+	ProtocolVersion    = 2
+	MinProtocolVersion = 2
+)
+
+// Version is the build version, set with -ldflags "-X main.Version=..."
+var Version = ""
+
+// Hello is exchanged right after connecting, so both sides know what they're
+// talking to before doing anything
+type Hello struct {
+	ProtocolVersion int
+	Version         string
+	Platform        string
+	Features        []string
+}
+
+const (
+	FeatureACL         = "acl"
+	FeatureXattrs      = "xattrs"
+	FeatureHardlinks   = "hardlinks"
+	FeatureDelta       = "delta"
+	FeatureWritable    = "writable"
+	FeatureSparse      = "sparse"
+	FeatureNames       = "names"
+	FeatureInodeFlags  = "inode-flags"
+	compressionFeature = "compression:"
+	checksumFeature    = "checksum:"
+)
+
+// the block checksum used for comparing files
+const checksumAlgorithm = "xxhash64"
+
+func buildVersion() string {
+	if Version != "" {
+		return Version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" {
+				return setting.Value
+			}
+		}
+	}
+	return "unknown"
+}
+
+// LocalHello describes this build and what it can do on this platform with
+// the given options
+func LocalHello(writable bool, o CompareOptions) Hello {
+	h := Hello{
+		ProtocolVersion: ProtocolVersion,
+		Version:         buildVersion(),
+		Platform:        runtime.GOOS + "/" + runtime.GOARCH,
+		Features: []string{
+			FeatureHardlinks,
+			FeatureDelta,
+			FeatureSparse,
+			FeatureNames,
+			compressionFeature + "none",
+			compressionFeature + "s2",
+			compressionFeature + "s2-better",
+			compressionFeature + "zstd",
+			checksumFeature + checksumAlgorithm,
+		},
+	}
+	if runtime.GOOS == "linux" {
+		h.Features = append(h.Features, FeatureACL)
+	}
+	if o.InodeFlags {
+		h.Features = append(h.Features, FeatureInodeFlags)
+	}
+	for _, name := range VerifyHashNames() {
+		h.Features = append(h.Features, checksumFeature+name)
+	}
+	if xattr.XATTR_SUPPORTED {
+		h.Features = append(h.Features, FeatureXattrs)
+	}
+	if writable {
+		h.Features = append(h.Features, FeatureWritable)
+	}
+	return h
+}
+
+func (h Hello) Has(feature string) bool {
+	return slices.Contains(h.Features, feature)
+}
+
+func (h Hello) String() string {
+	return fmt.Sprintf("fastsync %v (protocol %v) on %v", h.Version, h.ProtocolVersion, h.Platform)
+}
+
+// Hello tells the client who we are, and refuses clients that are too old
+func (s *Server) Hello(client Hello, reply *Hello) error {
+	logger.Info().Msgf("Client is %v with features %v", client, strings.Join(client.Features, ", "))
+	if client.ProtocolVersion < MinProtocolVersion {
+		return fmt.Errorf("client protocol version %v is too old, server needs at least %v", client.ProtocolVersion, MinProtocolVersion)
+	}
+	*reply = LocalHello(!s.ReadOnly, s.Options)
+	return nil
+}
+
+// ClientHello introduces us to the server and checks that we can work with it
+func ClientHello(client *RPCClient, o CompareOptions) (Hello, error) {
+	var server Hello
+	err := client.Call("Server.Hello", LocalHello(false, o), &server)
+	if err != nil {
+		if strings.Contains(err.Error(), "can't find method") {
+			return server, fmt.Errorf("server is too old to talk to, it needs protocol version %v or later", MinProtocolVersion)
+		}
+		return server, err
+	}
+	if server.ProtocolVersion < MinProtocolVersion {
+		return server, fmt.Errorf("server protocol version %v is too old, we need at least %v", server.ProtocolVersion, MinProtocolVersion)
+	}
+	if !server.Has(checksumFeature + checksumAlgorithm) {
+		return server, fmt.Errorf("server doesn't support %v checksums", checksumAlgorithm)
+	}
+	return server, nil
+}
+
+// UseServer turns off what the server can't do, or fails if the sync can't
+// be done at all. A dry run only reads, so it can push to a read only server.
+func (c *Client) UseServer(server Hello, push bool) error {
+	if push && !server.Has(FeatureWritable) && !c.DryRun {
+		return ErrReadOnly
+	}
+	if c.VerifyHash != "" && !server.Has(checksumFeature+c.VerifyHash) {
+		return fmt.Errorf("server can't hash files with %v", c.VerifyHash)
+	}
+	if c.Delta && !server.Has(FeatureDelta) {
+		logger.Warn().Msg("Server doesn't support delta transfers, comparing blocks at the same offsets instead")
+		c.Delta = false
+	}
+	if c.Sparse && !push && !server.Has(FeatureSparse) {
+		logger.Warn().Msg("Server can't tell where the holes in sparse files are, they will be filled in")
+		c.Sparse = false
+	}
+	if !server.Has(FeatureNames) && !c.Users.Numeric {
+		logger.Warn().Msg("Server doesn't know owner names, using numeric ids")
+		c.Users.Numeric = true
+		c.Groups.Numeric = true
+	}
+	if c.CompareOptions.InodeFlags && !server.Has(FeatureInodeFlags) {
+		// the server wouldn't tell us its flags, which would look like
+		// they should all be cleared
+		logger.Warn().Msg("Server wasn't started with --inode-flags, inode flags won't be transferred")
+		c.CompareOptions.InodeFlags = false
+	}
+	if c.SendACL && !server.Has(FeatureACL) {
+		logger.Warn().Msgf("Server on %v doesn't support ACLs, they won't be transferred", server.Platform)
+		c.SendACL = false
+	}
+	if !server.Has(FeatureXattrs) {
+		logger.Warn().Msgf("Server on %v doesn't support extended attributes, they won't be transferred", server.Platform)
+	}
+	if c.PreserveHardlinks && !server.Has(FeatureHardlinks) {
+		logger.Warn().Msg("Server doesn't support hardlinks, linked files will be copied")
+		c.PreserveHardlinks = false
+	}
+	return nil
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"os/user"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// names of local users and groups by id, so listing a directory doesn't look
+// up the same owner over and over
+var userNames, groupNames sync.Map
+
+func userName(uid uint32) string {
+	if name, found := userNames.Load(uid); found {
+		return name.(string)
+	}
+	var name string
+	if u, err := user.LookupId(strconv.FormatUint(uint64(uid), 10)); err == nil {
+		name = u.Username
+	}
+	userNames.Store(uid, name)
+	return name
+}
+
+func groupName(gid uint32) string {
+	if name, found := groupNames.Load(gid); found {
+		return name.(string)
+	}
+	var name string
+	if g, err := user.LookupGroupId(strconv.FormatUint(uint64(gid), 10)); err == nil {
+		name = g.Name
+	}
+	groupNames.Store(gid, name)
+	return name
+}
+
+// lookupID finds the id of a local user or group name
+func lookupID(name string, group bool) (uint32, error) {
+	var id string
+	if group {
+		g, err := user.LookupGroup(name)
+		if err != nil {
+			return 0, err
+		}
+		id = g.Gid
+	} else {
+		u, err := user.Lookup(name)
+		if err != nil {
+			return 0, err
+		}
+		id = u.Uid
+	}
+	n, err := strconv.ParseUint(id, 10, 32)
+	return uint32(n), err
+}
+
+type LookupIDArgs struct {
+	Name  string
+	Group bool
+}
+
+// LookupID finds the id a user or group name has on the server
+func (s *Server) LookupID(args LookupIDArgs, reply *uint32) error {
+	logger.Trace().Msgf("Looking up id of %s", args.Name)
+	id, err := lookupID(args.Name, args.Group)
+	*reply = id
+	return err
+}
+
+// idMapRule maps source ids or names matching from to the id or name in to
+type idMapRule struct {
+	pattern   string // name pattern like rsync, * matches everyone
+	low, high uint32 // id range when there's no pattern
+	to        string // name on the target, or empty if toid is used
+	toid      uint32
+}
+
+func (r idMapRule) match(id uint32, name string) bool {
+	if r.pattern == "" {
+		return id >= r.low && id <= r.high
+	}
+	if r.pattern == "*" {
+		return true
+	}
+	matched, _ := path.Match(r.pattern, name)
+	return matched
+}
+
+// IDMapper decides which user or group owns an entry on the target. Rules
+// are tried in order, then the name is looked up on the target unless
+// Numeric is set, and otherwise the id is kept as it is. Every source id is
+// only resolved once.
+type IDMapper struct {
+	Group   bool
+	Numeric bool // don't map by name, only by the rules
+
+	rules []idMapRule
+	cache sync.Map // source id => target id
+}
+
+func NewIDMapper(group bool) *IDMapper {
+	return &IDMapper{
+		Group: group,
+	}
+}
+
+// AddRules adds comma separated FROM:TO rules, where FROM is a name pattern,
+// an id or a range of ids like 1000-1999, and TO is a name or id. A rule
+// like *:nobody at the end catches everyone the other rules didn't.
+func (m *IDMapper) AddRules(spec string) error {
+	for _, rulespec := range strings.Split(spec, ",") {
+		rulespec = strings.TrimSpace(rulespec)
+		if rulespec == "" {
+			continue
+		}
+		from, to, found := strings.Cut(rulespec, ":")
+		if !found || from == "" || to == "" {
+			return fmt.Errorf("invalid rule %v, expected FROM:TO", rulespec)
+		}
+		var rule idMapRule
+		if low, high, isrange := strings.Cut(from, "-"); isdigits(low) && (!isrange || isdigits(high)) {
+			l, err := strconv.ParseUint(low, 10, 32)
+			if err != nil {
+				return fmt.Errorf("invalid id %v in rule %v", low, rulespec)
+			}
+			h := l
+			if isrange {
+				h, err = strconv.ParseUint(high, 10, 32)
+				if err != nil || h < l {
+					return fmt.Errorf("invalid id range %v in rule %v", from, rulespec)
+				}
+			}
+			rule.low, rule.high = uint32(l), uint32(h)
+		} else {
+			if _, err := path.Match(from, ""); err != nil {
+				return fmt.Errorf("invalid pattern %v in rule %v", from, rulespec)
+			}
+			rule.pattern = from
+		}
+		if isdigits(to) {
+			id, err := strconv.ParseUint(to, 10, 32)
+			if err != nil {
+				return fmt.Errorf("invalid id %v in rule %v", to, rulespec)
+			}
+			rule.toid = uint32(id)
+		} else {
+			rule.to = to
+		}
+		m.rules = append(m.rules, rule)
+	}
+	return nil
+}
+
+func isdigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// String describes the rules, for telling mappings apart
+func (m *IDMapper) String() string {
+	return fmt.Sprintf("numeric=%v %v", m.Numeric, m.rules)
+}
+
+func (m *IDMapper) kind() string {
+	if m.Group {
+		return "group"
+	}
+	return "user"
+}
+
+// Map returns the id on the target for the id and name of an entry on the
+// source, looking names up on the target
+func (m *IDMapper) Map(target Target, id uint32, name string) uint32 {
+	if mapped, found := m.cache.Load(id); found {
+		return mapped.(uint32)
+	}
+	mapped := m.resolve(target, id, name)
+	if mapped != id {
+		logger.Debug().Msgf("Mapping %v %v (%v) to %v", m.kind(), id, name, mapped)
+	}
+	m.cache.Store(id, mapped)
+	return mapped
+}
+
+func (m *IDMapper) resolve(target Target, id uint32, name string) uint32 {
+	for _, rule := range m.rules {
+		if !rule.match(id, name) {
+			continue
+		}
+		if rule.to == "" {
+			return rule.toid
+		}
+		mapped, err := target.LookupID(rule.to, m.Group)
+		if err != nil {
+			logger.Warn().Msgf("Can't map %v %v to %v, keeping the id: %v", m.kind(), id, rule.to, err)
+			return id
+		}
+		return mapped
+	}
+	if m.Numeric || name == "" {
+		return id
+	}
+	mapped, err := target.LookupID(name, m.Group)
+	if err != nil {
+		logger.Debug().Msgf("No %v %v on the target, keeping id %v", m.kind(), name, id)
+		return id
+	}
+	return mapped
+}
@@ -0,0 +1,46 @@
+package main
+
+// With CompareOptions.InodeFlags, the Linux inode flags (chattr attributes)
+// and the birth time of entries are read along with everything else, and the
+// flags are compared and applied after content and other metadata. Linux has
+// no way to set a birth time, so the one from the source is only recorded in
+// the changelog.
+
+// the inode flags that are transferred, the others are internal to the
+// filesystem (extents, inline data etc.) and can't be set
+const (
+	inodeFlagSync        = 0x00000008 // FS_SYNC_FL
+	inodeFlagImmutable   = 0x00000010 // FS_IMMUTABLE_FL
+	inodeFlagAppend      = 0x00000020 // FS_APPEND_FL
+	inodeFlagNodump      = 0x00000040 // FS_NODUMP_FL
+	inodeFlagNoatime     = 0x00000080 // FS_NOATIME_FL
+	inodeFlagDirsync     = 0x00010000 // FS_DIRSYNC_FL
+	inodeFlagTopdir      = 0x00020000 // FS_TOPDIR_FL
+	inodeFlagNocow       = 0x00800000 // FS_NOCOW_FL
+	inodeFlagProjinherit = 0x20000000 // FS_PROJINHERIT_FL
+
+	inodeFlagsMask = inodeFlagSync | inodeFlagImmutable | inodeFlagAppend | inodeFlagNodump |
+		inodeFlagNoatime | inodeFlagDirsync | inodeFlagTopdir | inodeFlagNocow | inodeFlagProjinherit
+
+	// entries with these can't be changed until they're cleared
+	inodeFlagsLocked = inodeFlagImmutable | inodeFlagAppend
+)
+
+// unlockInodeFlags clears immutable and append-only on an entry on the target
+// so it can be updated, applying the wanted metadata afterwards puts them
+// back. It returns true if the flags were cleared.
+func (c *Client) unlockInodeFlags(path string, fi *FileInfo) bool {
+	if !c.CompareOptions.InodeFlags || c.DryRun || fi.Flags&inodeFlagsLocked == 0 {
+		return false
+	}
+	logger.Debug().Msgf("Clearing immutable and append-only flags on %s while updating it", path)
+	unlocked := *fi
+	unlocked.Flags &^= inodeFlagsLocked
+	err := c.target.ApplyChanges(path, *fi, unlocked, c.CompareOptions)
+	if err != nil {
+		logger.Error().Msgf("Error clearing flags on %s: %v", path, err)
+		return false
+	}
+	fi.Flags = unlocked.Flags
+	return true
+}
@@ -0,0 +1,60 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"os"
+	"syscall"
+
+	unix "golang.org/x/sys/unix"
+)
+
+// readInodeFlags gets the birth time with statx and the inode flags with
+// FS_IOC_GETFLAGS, which needs the entry opened so only files and
+// directories have them
+func (fi *FileInfo) readInodeFlags(absolutepath string) {
+	var stx unix.Statx_t
+	err := unix.Statx(unix.AT_FDCWD, absolutepath, unix.AT_SYMLINK_NOFOLLOW, unix.STATX_BTIME, &stx)
+	if err == nil && stx.Mask&unix.STATX_BTIME != 0 {
+		fi.Btime = syscall.NsecToTimespec(stx.Btime.Sec*1e9 + int64(stx.Btime.Nsec))
+	}
+
+	if !fi.Mode.IsRegular() && !fi.Mode.IsDir() {
+		return
+	}
+	f, err := os.OpenFile(absolutepath, os.O_RDONLY|unix.O_NOFOLLOW|unix.O_NONBLOCK, 0)
+	if err != nil {
+		logger.Debug().Msgf("Can't open %v to get inode flags: %v", fi.Name, err)
+		return
+	}
+	defer f.Close()
+	flags, err := unix.IoctlGetUint32(int(f.Fd()), unix.FS_IOC_GETFLAGS)
+	if err != nil {
+		if err != unix.ENOTTY && err != unix.EOPNOTSUPP {
+			logger.Warn().Msgf("Failed to get inode flags for %v: %v", fi.Name, err)
+		}
+		return
+	}
+	fi.Flags = flags & inodeFlagsMask
+}
+
+// setInodeFlags changes the transferred flags of an entry, and keeps the
+// ones the filesystem manages itself
+func setInodeFlags(absolutepath string, flags uint32) error {
+	f, err := os.OpenFile(absolutepath, os.O_RDONLY|unix.O_NOFOLLOW|unix.O_NONBLOCK, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fd := int(f.Fd())
+	current, err := unix.IoctlGetUint32(fd, unix.FS_IOC_GETFLAGS)
+	if err != nil {
+		return err
+	}
+	wanted := current&^inodeFlagsMask | flags&inodeFlagsMask
+	if wanted == current {
+		return nil
+	}
+	return unix.IoctlSetPointerInt(fd, unix.FS_IOC_SETFLAGS, int(wanted))
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestBirthTimeInChangeLog(t *testing.T) {
+	sourcedir, targetdir := t.TempDir(), t.TempDir()
+	if err := os.WriteFile(filepath.Join(sourcedir, "file"), []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	options := CompareOptions{InodeFlags: true}
+	fi, err := PathToFileInfo(filepath.Join(sourcedir, "file"), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	btime := birthTime(fi)
+	if btime == nil {
+		t.Skip("filesystem doesn't have birth times")
+	}
+	if fi, _ := PathToFileInfo(filepath.Join(sourcedir, "file"), CompareOptions{}); birthTime(fi) != nil {
+		t.Error("birth time was read without inode flags")
+	}
+
+	source, target := NewLocalSource(sourcedir), NewLocalTarget(targetdir)
+	source.conn.Options, target.Options = options, options
+	var found bool
+	for _, entry := range syncWithOptions(t, source, target, options) {
+		if entry.Path != "/file" {
+			continue
+		}
+		found = true
+		if entry.Btime == nil || !entry.Btime.Equal(*btime) {
+			t.Errorf("changelog has birth time %v, expected %v", entry.Btime, btime)
+		}
+	}
+	if !found {
+		t.Error("file isn't in the changelog")
+	}
+}
+
+func TestBirthTime(t *testing.T) {
+	if birthTime(FileInfo{}) != nil {
+		t.Error("unknown birth time isn't nil")
+	}
+	at := time.Date(2001, 2, 3, 4, 5, 6, 7, time.UTC)
+	fi := FileInfo{Btime: syscall.NsecToTimespec(at.UnixNano())}
+	if btime := birthTime(fi); btime == nil || !btime.Equal(at) {
+		t.Errorf("birth time is %v, expected %v", btime, at)
+	}
+}
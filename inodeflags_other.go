@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+// readInodeFlags does nothing, inode flags are a Linux thing
+func (fi *FileInfo) readInodeFlags(absolutepath string) {
+}
+
+func setInodeFlags(absolutepath string, flags uint32) error {
+	return ErrNotSupportedByPlatform
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const journalVersion = 2
+
+// how often progress is recorded while processing a large file
+const journalProgressInterval = 64 * 1024 * 1024
+
+// journalRecord is one line in the journal file. The first line is a header
+// identifying the sync, the rest record progress.
+type journalRecord struct {
+	Type string `json:"t"` // h = header, p = file progress, f = file completed
+
+	// header
+	Version  int    `json:"v,omitempty"`
+	Identity string `json:"id,omitempty"`
+
+	Path   string `json:"p,omitempty"`
+	Mtime  int64  `json:"m,omitempty"`
+	Ctime  int64  `json:"c,omitempty"`
+	Size   int64  `json:"s,omitempty"`
+	Offset int64  `json:"o,omitempty"`
+	Temp   string `json:"tmp,omitempty"` // file progress was made in, if it's replacing the target
+}
+
+type journalEntry struct {
+	mtime, ctime int64
+	size, offset int64
+	temp         string
+}
+
+// Journal records the progress of a sync in a state directory, so a restarted
+// client can skip files that were completely synced and resume large files
+// where it left off. A nil Journal records nothing.
+//
+// Directories are always listed again, and files are only skipped or resumed
+// if their size and times on the source are still what was recorded, so
+// changes made while the sync was interrupted are picked up.
+type Journal struct {
+	lock     sync.Mutex
+	filename string
+	file     *os.File
+	writer   *bufio.Writer
+
+	completed map[string]journalEntry
+	files     map[string]journalEntry // partially synced
+}
+
+// OpenJournal opens the journal for the sync described by name (where we sync
+// from and to). The identity describes the source and the options used, and if
+// it doesn't match what is in the journal, the journal is discarded.
+func OpenJournal(statedir, name, identity string) (*Journal, error) {
+	err := os.MkdirAll(statedir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	namehash := sha256.Sum256([]byte(name))
+	j := &Journal{
+		filename:  filepath.Join(statedir, "journal-"+hex.EncodeToString(namehash[:8])+".json"),
+		completed: make(map[string]journalEntry),
+		files:     make(map[string]journalEntry),
+	}
+
+	valid := j.load(identity)
+
+	flags := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	if !valid {
+		flags |= os.O_TRUNC
+	}
+	j.file, err = os.OpenFile(j.filename, flags, 0600)
+	if err != nil {
+		return nil, err
+	}
+	j.writer = bufio.NewWriter(j.file)
+	if !valid {
+		j.write(journalRecord{
+			Type:     "h",
+			Version:  journalVersion,
+			Identity: identity,
+		})
+	}
+	return j, nil
+}
+
+// load reads an existing journal, returning false if there is none or it's
+// not for the same source and options
+func (j *Journal) load(identity string) bool {
+	f, err := os.Open(j.filename)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	if !scanner.Scan() {
+		return false
+	}
+	var header journalRecord
+	if json.Unmarshal(scanner.Bytes(), &header) != nil || header.Type != "h" || header.Version != journalVersion {
+		logger.Warn().Msgf("Journal %v is not valid, starting from scratch", j.filename)
+		return false
+	}
+	if header.Identity != identity {
+		logger.Warn().Msgf("Source or options have changed since journal %v was written, starting from scratch", j.filename)
+		return false
+	}
+
+	for scanner.Scan() {
+		var record journalRecord
+		if json.Unmarshal(scanner.Bytes(), &record) != nil {
+			// probably a partial line from a crash, ignore it
+			continue
+		}
+		entry := journalEntry{
+			mtime:  record.Mtime,
+			ctime:  record.Ctime,
+			size:   record.Size,
+			offset: record.Offset,
+			temp:   record.Temp,
+		}
+		switch record.Type {
+		case "p":
+			j.files[record.Path] = entry
+		case "f":
+			delete(j.files, record.Path)
+			j.completed[record.Path] = entry
+		}
+	}
+	logger.Info().Msgf("Resuming from journal %v with %v completed and %v partial files", j.filename, len(j.completed), len(j.files))
+	return true
+}
+
+func (j *Journal) write(record journalRecord) {
+	data, _ := json.Marshal(record)
+	j.writer.Write(append(data, '\n'))
+	// flush every time, so we lose as little as possible if we crash
+	err := j.writer.Flush()
+	if err != nil {
+		logger.Error().Msgf("Error writing to journal %v: %v", j.filename, err)
+	}
+}
+
+// Completed returns true if the file was completely synced in an earlier run,
+// and its size, contents and metadata haven't changed since
+func (j *Journal) Completed(fi FileInfo) bool {
+	if j == nil {
+		return false
+	}
+	j.lock.Lock()
+	entry, found := j.completed[fi.Name]
+	j.lock.Unlock()
+	return found && entry.size == fi.Size && entry.mtime == fi.Mtim.Nano() && entry.ctime == fi.Ctim.Nano()
+}
+
+// ResumeOffset returns how far the file was verified in an earlier run, or
+// zero if it has to be processed from the start. If the progress was made in a
+// temporary file replacing the target, that is returned as well, even if it
+// can't be resumed so it can be removed.
+func (j *Journal) ResumeOffset(fi FileInfo) (int64, string) {
+	if j == nil {
+		return 0, ""
+	}
+	j.lock.Lock()
+	entry, found := j.files[fi.Name]
+	j.lock.Unlock()
+	if !found || entry.mtime != fi.Mtim.Nano() || entry.size != fi.Size {
+		return 0, entry.temp
+	}
+	return entry.offset, entry.temp
+}
+
+// FileProgress records that the file is identical to the source up to offset,
+// in the temporary file temp if that's not blank
+func (j *Journal) FileProgress(fi FileInfo, offset int64, temp string) {
+	if j == nil {
+		return
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.files[fi.Name] = journalEntry{
+		mtime:  fi.Mtim.Nano(),
+		size:   fi.Size,
+		offset: offset,
+		temp:   temp,
+	}
+	j.write(journalRecord{
+		Type:   "p",
+		Path:   fi.Name,
+		Mtime:  fi.Mtim.Nano(),
+		Size:   fi.Size,
+		Offset: offset,
+		Temp:   temp,
+	})
+}
+
+// FileCompleted records that the file and its metadata are synced, and
+// forgets progress recorded for it
+func (j *Journal) FileCompleted(fi FileInfo) {
+	if j == nil {
+		return
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	delete(j.files, fi.Name)
+	j.completed[fi.Name] = journalEntry{
+		mtime: fi.Mtim.Nano(),
+		ctime: fi.Ctim.Nano(),
+		size:  fi.Size,
+	}
+	j.write(journalRecord{
+		Type:  "f",
+		Path:  fi.Name,
+		Mtime: fi.Mtim.Nano(),
+		Ctime: fi.Ctim.Nano(),
+		Size:  fi.Size,
+	})
+}
+
+// Finish removes the journal after a successful sync
+func (j *Journal) Finish() {
+	if j == nil {
+		return
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.writer.Flush()
+	j.file.Close()
+	err := os.Remove(j.filename)
+	if err != nil {
+		logger.Error().Msgf("Error removing journal %v: %v", j.filename, err)
+	}
+	j.file = nil
+}
+
+func (j *Journal) Close() error {
+	if j == nil {
+		return nil
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if j.file == nil {
+		return nil
+	}
+	err := j.writer.Flush()
+	if err != nil {
+		j.file.Close()
+		return err
+	}
+	return j.file.Close()
+}
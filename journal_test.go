@@ -0,0 +1,134 @@
+package main
+
+import (
+	"syscall"
+	"testing"
+)
+
+func TestJournalResume(t *testing.T) {
+	statedir := t.TempDir()
+	j, err := OpenJournal(statedir, "test", "identity")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inplace := FileInfo{Name: "/inplace", Size: 1 << 30, Mtim: syscall.Timespec{Sec: 1}}
+	replaced := FileInfo{Name: "/replaced", Size: 1 << 30, Mtim: syscall.Timespec{Sec: 2}}
+	j.FileProgress(inplace, 64<<20, "")
+	j.FileProgress(replaced, 64<<20, "/.replaced.1.fastsync")
+	j.FileProgress(replaced, 128<<20, "/.replaced.1.fastsync")
+	j.Close()
+
+	j, err = OpenJournal(statedir, "test", "identity")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	if offset, temp := j.ResumeOffset(inplace); offset != 64<<20 || temp != "" {
+		t.Errorf("in place file resumes at %v in %q", offset, temp)
+	}
+	if offset, temp := j.ResumeOffset(replaced); offset != 128<<20 || temp != "/.replaced.1.fastsync" {
+		t.Errorf("replaced file resumes at %v in %q", offset, temp)
+	}
+
+	changed := replaced
+	changed.Mtim.Sec++
+	if offset, temp := j.ResumeOffset(changed); offset != 0 || temp != "/.replaced.1.fastsync" {
+		t.Errorf("changed file resumes at %v, and the temporary file to remove is %q", offset, temp)
+	}
+
+	j.FileCompleted(replaced)
+	if offset, temp := j.ResumeOffset(replaced); offset != 0 || temp != "" {
+		t.Errorf("completed file resumes at %v in %q", offset, temp)
+	}
+}
+
+func TestJournalIdentity(t *testing.T) {
+	statedir := t.TempDir()
+	j, err := OpenJournal(statedir, "test", "identity")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := FileInfo{Name: "/file", Size: 1 << 30}
+	j.FileProgress(file, 64<<20, "")
+	j.Close()
+
+	j, err = OpenJournal(statedir, "test", "other identity")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	if offset, _ := j.ResumeOffset(file); offset != 0 {
+		t.Errorf("journal for another identity resumes at %v", offset)
+	}
+}
+
+func TestJournalCompleted(t *testing.T) {
+	statedir := t.TempDir()
+	j, err := OpenJournal(statedir, "test", "identity")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := FileInfo{Name: "/dir/file", Size: 100, Mtim: syscall.Timespec{Sec: 1}, Ctim: syscall.Timespec{Sec: 2}}
+	partial := FileInfo{Name: "/dir/partial", Size: 1 << 30, Mtim: syscall.Timespec{Sec: 1}}
+	j.FileProgress(file, 64<<20, "")
+	j.FileCompleted(file)
+	j.FileProgress(partial, 64<<20, "")
+	j.Close()
+
+	j, err = OpenJournal(statedir, "test", "identity")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	if !j.Completed(file) {
+		t.Error("completed file isn't completed after reopening the journal")
+	}
+	if offset, _ := j.ResumeOffset(file); offset != 0 {
+		t.Errorf("completed file resumes at %v", offset)
+	}
+	if j.Completed(partial) {
+		t.Error("partially synced file is completed")
+	}
+	for _, change := range []func(*FileInfo){
+		func(fi *FileInfo) { fi.Size++ },
+		func(fi *FileInfo) { fi.Mtim.Nsec++ },
+		func(fi *FileInfo) { fi.Ctim.Nsec++ },
+	} {
+		changed := file
+		change(&changed)
+		if j.Completed(changed) {
+			t.Errorf("file changed to %+v is still completed", changed)
+		}
+	}
+	if j.Completed(FileInfo{Name: "/dir/other"}) {
+		t.Error("file that wasn't completed is completed")
+	}
+}
+
+func TestJournalIdentityOptions(t *testing.T) {
+	root := FileInfo{Name: "/", IsDir: true, Dev: 1, Inode: 2}
+	identity := func(change func(c *Client)) string {
+		c := NewClient()
+		c.Filter = &Filter{}
+		c.Filter.Add(false, "*.tmp")
+		change(c)
+		return c.journalIdentity(root)
+	}
+	base := identity(func(c *Client) {})
+	if identity(func(c *Client) {}) != base {
+		t.Fatal("identity isn't stable")
+	}
+	for name, change := range map[string]func(c *Client){
+		"exclude":   func(c *Client) { c.Filter.Add(false, "*.bak") },
+		"include":   func(c *Client) { c.Filter = &Filter{}; c.Filter.Add(true, "*.tmp") },
+		"delete":    func(c *Client) { c.Delete = true },
+		"checksum":  func(c *Client) { c.AlwaysChecksum = true },
+		"inplace":   func(c *Client) { c.InPlace = true },
+		"blocksize": func(c *Client) { c.BlockSize *= 2 },
+		"usermap":   func(c *Client) { c.Users.AddRules("1000:0") },
+	} {
+		if identity(change) == base {
+			t.Errorf("identity is the same with a different %v option", name)
+		}
+	}
+}
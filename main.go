@@ -1,11 +1,15 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"crypto/tls"
 	"fmt"
 	"log"
 	"net"
 	"net/rpc"
 	"os"
+	"path/filepath"
 	"runtime"
 	"runtime/metrics"
 	"runtime/pprof"
@@ -13,6 +17,7 @@ import (
 	"time"
 
 	"github.com/dustin/go-humanize"
+	"github.com/pkg/xattr"
 	"github.com/rs/zerolog"
 	"github.com/spf13/pflag"
 	"github.com/ugorji/go/codec"
@@ -28,14 +33,51 @@ func main() {
 	// sync settings
 	bind := pflag.String("bind", "0.0.0.0:7331", "Address to bind/connect to")
 	hardlinks := pflag.Bool("hardlinks", true, "Preserve hardlinks")
+	fakesuper := pflag.Bool("fake-super", false, "Store owner, mode and special files in a "+fakeSuperXattr+" extended attribute instead of applying them, and read them back from it, so it works without root")
+	inodeflags := pflag.Bool("inode-flags", false, "Preserve Linux inode flags like immutable, append-only, nodump and nocow (needs the server started with it too)")
+	numericids := pflag.Bool("numeric-ids", false, "Keep owner and group ids as they are instead of mapping them by name")
+	usermap := pflag.StringArray("usermap", nil, "Map owners with FROM:TO rules separated by commas, where FROM is a name pattern, id or id range and TO a name or id, like *:nobody (can be repeated)")
+	groupmap := pflag.StringArray("groupmap", nil, "Map groups with FROM:TO rules like --usermap (can be repeated)")
 	directory := pflag.String("directory", ".", "Directory to use as source or target")
+	writable := pflag.Bool("writable", false, "Allow clients to push files to this server")
+	preserveatime := pflag.Bool("preserve-source-atime", false, "Read source files without changing their access times, using O_NOATIME where allowed and restoring them otherwise")
+	maxopenfiles := pflag.Int("max-open-files", 0, "Maximum number of files clients can have open on the server at once, 0 for no limit")
+	// security settings
+	tlscert := pflag.String("tls-cert", "", "TLS certificate file (enables TLS on server)")
+	tlskey := pflag.String("tls-key", "", "TLS private key file")
+	tlsca := pflag.String("tls-ca", "", "CA certificate file to verify the other side with (server requires client certificates when set)")
+	bwlimit := pflag.String("bwlimit", "0", "Limit bandwidth in each direction to this many bytes per second after compression, like 500KB or 10MiB, 0 for no limit")
+	bwschedule := pflag.String("bwschedule", "", "File with times of day and bandwidth limits to use from then on, checked for changes while running")
+	compress := pflag.String("compress", "", "Compression: none, s2, s2-better or zstd[:level] (clients ask the server for it, servers use it when the client doesn't care, default s2)")
+	secretfile := pflag.String("secret-file", "", "File with shared secret for authentication (default is the FASTSYNC_SECRET environment variable, none disables authentication)")
 	// transfer decision settings
 	acl := pflag.Bool("acl", true, "Transfer ACLs")
 	checksum := pflag.Bool("checksum", false, "Checksum files")
 	delete := pflag.Bool("delete", false, "Delete extra local files (mirror)")
+	verifyhash := pflag.String("verify-hash", "", "Hash transferred files on both sides with sha256, blake3 or xxh3-128 and fail them if they differ, also used by the verify command (default sha256 there)")
+	delta := pflag.Bool("delta", false, "Find changed parts of files with a rolling checksum, so inserted or removed data doesn't resend the rest of the file")
+	sparse := pflag.Bool("sparse", true, "Keep holes in sparse files instead of transferring and writing zeros")
+	sparsezeros := pflag.Bool("sparse-zeros", false, "Also leave blocks that are all zeros as holes, making files sparse that weren't")
+	inplace := pflag.Bool("inplace", false, "Update changed files directly instead of building a new copy and renaming it over the old one")
+	dryrun := pflag.Bool("dry-run", false, "Compare everything but only report what would be changed")
+	dryrunlist := pflag.String("dry-run-list", "", "Write itemized list of changes a dry run would do to file")
+	changelog := pflag.String("changelog", "", "Write a JSON line for each changed, skipped or failed entry to file")
+	deleteexcluded := pflag.Bool("delete-excluded", false, "Also delete local files that are excluded by filters")
+	// filter rules are added as they're parsed, so the first one given that
+	// matches decides
+	filter := &Filter{}
+	pflag.Var(filterFlag{filter: filter, include: true}, "include", "Include files matching pattern, unless an earlier rule excludes them (can be repeated)")
+	pflag.Var(filterFlag{filter: filter}, "exclude", "Exclude files matching pattern, unless an earlier rule includes them (can be repeated)")
+	pflag.Var(filterFlag{filter: filter, fromfile: true}, "exclude-from", "Read exclude patterns from file, checked where it is among the other rules (can be repeated)")
+	statedir := pflag.String("state-dir", "", "Directory for a journal that lets an interrupted sync skip files it completed and resume large files where it left off, as long as they didn't change on the source")
 	// performance settings
 	parallelfile := pflag.Int("pfile", 4096, "Number of parallel file IO operations")
 	paralleldir := pflag.Int("pdir", 512, "Number of parallel dir scanning operations")
+	parallelstream := pflag.Int("pstream", 64, "Number of files streamed in parallel")
+	streamwindow := pflag.Int("streamwindow", 16, "Number of blocks in flight for each streamed file")
+	connections := pflag.Int("connections", 1, "Number of connections to the server, calls are spread over them")
+	reconnect := pflag.Int("reconnect", 10, "Number of times to try reconnecting to the server when a connection breaks, with increasing delays, 0 to give up right away")
+	timeout := pflag.Int("timeout", 300, "Consider a connection broken if the server doesn't respond for N seconds, 0 to wait forever")
 	transferblocksize := pflag.Int("blocksize", 128*1024, "Transfer/checksum block size")
 	// debugging etc
 	loglevel := pflag.String("loglevel", "info", "Log level")
@@ -146,6 +188,65 @@ func main() {
 	}
 	logger = logger.Level(zll)
 
+	secret, err := LoadSecret(*secretfile)
+	if err != nil {
+		logger.Fatal().Msgf("Error loading shared secret: %v", err)
+	}
+
+	limit, err := ParseBandwidth(*bwlimit)
+	if err != nil {
+		logger.Fatal().Msgf("Error in --bwlimit: %v", err)
+	}
+	// shared by all connections, so the limit is for all of them together
+	bandwidth := NewBandwidthLimiter(limit)
+	if *bwschedule != "" {
+		err = bandwidth.RunSchedule(*bwschedule)
+		if err != nil {
+			logger.Fatal().Msgf("Error loading bandwidth schedule: %v", err)
+		}
+	} else if bandwidth.Limit() > 0 {
+		logger.Info().Msgf("Bandwidth limit is %v", formatBandwidth(bandwidth.Limit()))
+	}
+
+	if *transferblocksize < 1 || *transferblocksize > maxChunkSize {
+		logger.Fatal().Msgf("--blocksize has to be between 1 and %v", maxChunkSize)
+	}
+
+	// delta builds the new file next to the old one, which in place doesn't
+	if *delta && *inplace {
+		logger.Fatal().Msg("--delta can't be used with --inplace")
+	}
+
+	if *compress != "" {
+		_, err = ParseCompression(*compress)
+		if err != nil {
+			logger.Fatal().Msgf("Error in --compress: %v", err)
+		}
+	}
+
+	// how entries are read and changed on this side
+	var options CompareOptions
+	if *fakesuper {
+		if !xattr.XATTR_SUPPORTED {
+			logger.Fatal().Msg("--fake-super needs extended attributes, which this platform doesn't support")
+		}
+		options.FakeSuper = true
+	}
+
+	if *inodeflags {
+		if runtime.GOOS != "linux" {
+			logger.Fatal().Msg("--inode-flags only works on Linux")
+		}
+		options.InodeFlags = true
+	}
+
+	if *verifyhash != "" {
+		*verifyhash, err = ParseVerifyHash(*verifyhash)
+		if err != nil {
+			logger.Fatal().Msgf("Error in --verify-hash: %v", err)
+		}
+	}
+
 	if len(pflag.Args()) == 0 {
 		logger.Fatal().Msg("Need command argument")
 	}
@@ -155,22 +256,53 @@ func main() {
 	// signal.Notify(signals, os.Interrupt)
 
 	switch strings.ToLower(pflag.Arg(0)) {
-	case "server":
-		server := rpc.NewServer()
-		serverobject := &Server{
-			BasePath: *directory,
-			ReadOnly: true,
-			shutdown: make(chan struct{}),
+	case "gencert":
+		if *tlscert == "" || *tlskey == "" {
+			logger.Fatal().Msg("Need --tls-cert and --tls-key to know where to write the certificate and key")
+		}
+		hosts := []string{"localhost", "127.0.0.1", "::1"}
+		if hostname, err := os.Hostname(); err == nil {
+			hosts = append(hosts, hostname)
+		}
+		if host, _, err := net.SplitHostPort(*bind); err == nil {
+			if ip := net.ParseIP(host); ip == nil || !ip.IsUnspecified() {
+				hosts = append(hosts, host)
+			}
 		}
-		err := server.Register(serverobject)
+		hosts = append(hosts, pflag.Args()[1:]...)
+		err := GenerateSelfSignedCert(*tlscert, *tlskey, hosts, 10*365*24*time.Hour)
 		if err != nil {
-			logger.Fatal().Msgf("Error registering server object: %v", err)
+			logger.Fatal().Msgf("Error generating certificate: %v", err)
 		}
+		logger.Info().Msgf("Wrote self signed certificate for %v to %s and key to %s, use the certificate as --tls-ca on both sides", strings.Join(hosts, ", "), *tlscert, *tlskey)
+	case "server":
+		serverobject := NewServer(*directory, !*writable)
+		serverobject.MaxOpenFiles = *maxopenfiles
+		serverobject.PreserveAtime = *preserveatime
+		serverobject.Options = options
 
-		listener, err := net.Listen("tcp", *bind)
+		// keepalives make the kernel notice clients that went away without
+		// closing the connection, so their open files get closed
+		listenconfig := net.ListenConfig{KeepAlive: tcpKeepAlive}
+		listener, err := listenconfig.Listen(context.Background(), "tcp", *bind)
 		if err != nil {
 			logger.Fatal().Msgf("Error binding listener: %v", err)
 		}
+		if *tlscert != "" || *tlskey != "" || *tlsca != "" {
+			tlsconfig, err := ServerTLSConfig(*tlscert, *tlskey, *tlsca)
+			if err != nil {
+				logger.Fatal().Msgf("Error setting up TLS: %v", err)
+			}
+			listener = tls.NewListener(listener, tlsconfig)
+			logger.Info().Msgf("Using TLS (client certificates required: %v)", *tlsca != "")
+		}
+		if len(secret) > 0 {
+			logger.Info().Msg("Clients must authenticate using the shared secret")
+		}
+		servercompression := DefaultCompression
+		if *compress != "" {
+			servercompression, _ = ParseCompression(*compress)
+		}
 		logger.Info().Msgf("Listening on %s", *bind)
 		go func() {
 			for {
@@ -180,12 +312,63 @@ func main() {
 					logger.Error().Msgf("Error accepting connection: %v", err)
 					continue
 				}
-				wconn := NewPerformanceWrapper(conn, p.GetAtomicAdder(RecievedOverWire), p.GetAtomicAdder(SentOverWire))
-				cconn := CompressedReadWriteCloser(wconn)
-				wcconn := NewPerformanceWrapper(cconn, p.GetAtomicAdder(RecievedBytes), p.GetAtomicAdder(SentBytes))
 				go func() {
+					if tlsconn, ok := conn.(*tls.Conn); ok {
+						// a client that connects and says nothing mustn't hold
+						// the goroutine and socket forever
+						conn.SetDeadline(time.Now().Add(30 * time.Second))
+						err := tlsconn.Handshake()
+						if err != nil {
+							logger.Error().Msgf("TLS handshake with %v failed: %v", conn.RemoteAddr(), err)
+							conn.Close()
+							return
+						}
+						conn.SetDeadline(time.Time{})
+					}
+					if len(secret) > 0 {
+						conn.SetDeadline(time.Now().Add(30 * time.Second))
+						err := ServerAuthenticate(conn, secret)
+						if err != nil {
+							logger.Error().Msgf("Authentication of %v failed: %v", conn.RemoteAddr(), err)
+							conn.Close()
+							return
+						}
+						conn.SetDeadline(time.Time{})
+					}
+
+					wconn := NewPerformanceWrapper(conn, p.GetAtomicAdder(RecievedOverWire), p.GetAtomicAdder(SentOverWire))
+					wconn.SetLimiter(bandwidth)
+					conn.SetDeadline(time.Now().Add(30 * time.Second))
+					compression, err := ServerNegotiateCompression(wconn, servercompression)
+					if err != nil {
+						logger.Error().Msgf("Compression negotiation with %v failed: %v", conn.RemoteAddr(), err)
+						conn.Close()
+						return
+					}
+					conn.SetDeadline(time.Time{})
+					logger.Debug().Msgf("Using %v compression with %v", compression, conn.RemoteAddr())
+					cconn, err := CompressedReadWriteCloser(wconn, compression)
+					if err != nil {
+						logger.Error().Msgf("Error setting up compression for %v: %v", conn.RemoteAddr(), err)
+						conn.Close()
+						return
+					}
+					wcconn := NewPerformanceWrapper(cconn, p.GetAtomicAdder(RecievedBytes), p.GetAtomicAdder(SentBytes))
+
+					// open files belong to the connection, so every connection
+					// gets its own RPC server
+					connection := NewConnection(serverobject)
+					server := rpc.NewServer()
+					err = server.RegisterName("Server", connection)
+					if err != nil {
+						logger.Error().Msgf("Error registering server object: %v", err)
+						conn.Close()
+						return
+					}
+
 					var h codec.MsgpackHandle
 					server.ServeCodec(codec.GoRpc.ServerCodec(wcconn, &h))
+					connection.CloseAll()
 					logger.Info().Msgf("Closed connection from %v", conn.RemoteAddr())
 				}()
 			}
@@ -195,25 +378,75 @@ func main() {
 			serverobject.Shutdown(nil, nil)
 		}()
 		serverobject.Wait()
-	case "client", "shutdown":
+	case "client", "push", "shutdown", "verify":
 		//RPC Communication (client side)
-		conn, err := net.Dial("tcp", *bind)
-		if err != nil {
-			logger.Fatal().Msgf("Error connecting to %s: %v", *bind, err)
+		var tlsconfig *tls.Config
+		if *tlscert != "" || *tlskey != "" || *tlsca != "" {
+			host, _, _ := net.SplitHostPort(*bind)
+			tlsconfig, err = ClientTLSConfig(*tlscert, *tlskey, *tlsca, host)
+			if err != nil {
+				logger.Fatal().Msgf("Error setting up TLS: %v", err)
+			}
 		}
-		logger.Info().Msgf("Connected to %s", *bind)
+		dialer := &net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: tcpKeepAlive,
+		}
+		dial := func() (rpc.ClientCodec, error) {
+			var conn net.Conn
+			var err error
+			if tlsconfig != nil {
+				conn, err = tls.DialWithDialer(dialer, "tcp", *bind, tlsconfig)
+			} else {
+				conn, err = dialer.Dial("tcp", *bind)
+			}
+			if err != nil {
+				return nil, err
+			}
 
-		wconn := NewPerformanceWrapper(conn, p.GetAtomicAdder(RecievedOverWire), p.GetAtomicAdder(SentOverWire))
-		cconn := CompressedReadWriteCloser(wconn)
-		wcconn := NewPerformanceWrapper(cconn, p.GetAtomicAdder(RecievedBytes), p.GetAtomicAdder(SentBytes))
+			if len(secret) > 0 {
+				conn.SetDeadline(time.Now().Add(30 * time.Second))
+				err = ClientAuthenticate(conn, secret)
+				if err != nil {
+					conn.Close()
+					return nil, err
+				}
+				conn.SetDeadline(time.Time{})
+			}
 
-		var h codec.MsgpackHandle
-		rpcCodec := codec.GoRpc.ClientCodec(wcconn, &h)
-		rpcClient := rpc.NewClientWithCodec(rpcCodec)
+			// counters are shared, so they add up across all connections
+			wconn := NewPerformanceWrapper(conn, p.GetAtomicAdder(RecievedOverWire), p.GetAtomicAdder(SentOverWire))
+			wconn.SetLimiter(bandwidth)
+			conn.SetDeadline(time.Now().Add(30 * time.Second))
+			compression, err := ClientNegotiateCompression(wconn, *compress)
+			if err != nil {
+				conn.Close()
+				return nil, err
+			}
+			conn.SetDeadline(time.Time{})
+			logger.Debug().Msgf("Using %v compression", compression)
+			cconn, err := CompressedReadWriteCloser(wconn, compression)
+			if err != nil {
+				conn.Close()
+				return nil, err
+			}
+			wcconn := NewPerformanceWrapper(cconn, p.GetAtomicAdder(RecievedBytes), p.GetAtomicAdder(SentBytes))
+
+			var h codec.MsgpackHandle
+			return codec.GoRpc.ClientCodec(wcconn, &h), nil
+		}
+
+		pool, err := DialPool(*connections, func() (*RPCClient, error) {
+			return DialRPCClient(dial, *reconnect, time.Duration(*timeout)*time.Second)
+		})
+		if err != nil {
+			logger.Fatal().Msgf("Error connecting to %s: %v", *bind, err)
+		}
+		logger.Info().Msgf("Connected to %s using %v connections", *bind, pool.Len())
 
 		if strings.ToLower(pflag.Arg(0)) == "shutdown" {
 			logger.Info().Msg("Shutting down server")
-			err := rpcClient.Call("Server.Shutdown", nil, nil)
+			err := pool.For("").Call("Server.Shutdown", nil, nil)
 			if err != nil {
 				logger.Fatal().Msgf("Error shutting down: %v", err)
 			}
@@ -221,15 +454,82 @@ func main() {
 			os.Exit(0)
 		}
 
+		serverhello, err := ClientHello(pool.For(""), options)
+		if err != nil {
+			logger.Fatal().Msgf("Can't work with server %s: %v", *bind, err)
+		}
+		logger.Info().Msgf("Server is %v", serverhello)
+
 		c := NewClient()
-		c.BasePath = *directory
 		c.PreserveHardlinks = *hardlinks
 		c.ParallelDir = *paralleldir
 		c.ParallelFile = *parallelfile
+		c.ParallelStream = *parallelstream
+		c.StreamWindow = *streamwindow
 		c.BlockSize = *transferblocksize
 		c.AlwaysChecksum = *checksum
 		c.SendACL = *acl
 		c.Delete = *delete
+		c.DeleteExcluded = *deleteexcluded
+		c.InPlace = *inplace
+		c.Delta = *delta
+		c.VerifyHash = *verifyhash
+		c.CompareOptions = options
+		c.Sparse = *sparse
+		c.Users.Numeric = *numericids
+		c.Groups.Numeric = *numericids
+		for _, spec := range *usermap {
+			err = c.Users.AddRules(spec)
+			if err != nil {
+				logger.Fatal().Msgf("Error in --usermap: %v", err)
+			}
+		}
+		for _, spec := range *groupmap {
+			err = c.Groups.AddRules(spec)
+			if err != nil {
+				logger.Fatal().Msgf("Error in --groupmap: %v", err)
+			}
+		}
+		c.SparseZeros = *sparsezeros
+		if c.VerifyHash == "" && strings.ToLower(pflag.Arg(0)) == "verify" {
+			c.VerifyHash = "sha256"
+		}
+		if *statedir != "" {
+			absdirectory, err := filepath.Abs(*directory)
+			if err != nil {
+				logger.Fatal().Msgf("Error resolving directory %v: %v", *directory, err)
+			}
+			c.StateDir = *statedir
+			c.StateName = strings.ToLower(pflag.Arg(0)) + " " + *bind + " " + absdirectory
+		}
+
+		c.DryRun = *dryrun
+		err = c.UseServer(serverhello, strings.ToLower(pflag.Arg(0)) == "push")
+		if err != nil {
+			logger.Fatal().Msgf("Can't sync with server %s: %v", *bind, err)
+		}
+
+		if filter.Len() > 0 {
+			c.Filter = filter
+		}
+
+		var dryrunlistfile *os.File
+		var dryrunlistwriter *bufio.Writer
+		if *dryrun && *dryrunlist != "" {
+			dryrunlistfile, err = os.Create(*dryrunlist)
+			if err != nil {
+				logger.Fatal().Msgf("Error creating dry run list: %v", err)
+			}
+			dryrunlistwriter = bufio.NewWriter(dryrunlistfile)
+			c.DryRunList = dryrunlistwriter
+		}
+
+		if *changelog != "" {
+			c.ChangeLog, err = NewChangeLog(*changelog)
+			if err != nil {
+				logger.Fatal().Msgf("Error creating changelog: %v", err)
+			}
+		}
 
 		var totalhistory performanceentry
 
@@ -265,12 +565,31 @@ func main() {
 			<-signals
 			c.Abort()
 		}()
-		err = c.Run(rpcClient)
+		var differences int64
+		switch strings.ToLower(pflag.Arg(0)) {
+		case "push":
+			source := NewLocalSource(*directory)
+			source.conn.PreserveAtime = *preserveatime
+			source.conn.Options = options
+			err = c.Run(source, NewRemoteTarget(pool))
+		case "verify":
+			var files int64
+			target := NewLocalTarget(*directory)
+			target.Options = options
+			files, differences, err = c.Verify(NewRemoteSource(pool), target)
+			if err == nil {
+				logger.Warn().Msgf("Verified %v files with %v, found %v differences", files, c.VerifyHash, differences)
+			}
+		default:
+			target := NewLocalTarget(*directory)
+			target.Options = options
+			err = c.Run(NewRemoteSource(pool), target)
+		}
 		if err != nil {
 			logger.Error().Msgf("Error running client: %v", err)
 		}
 
-		rpcClient.Close()
+		pool.Close()
 
 		lasthistory := p.NextHistory()
 		totalhistory = totalhistory.Add(lasthistory)
@@ -283,6 +602,20 @@ func main() {
 			totalhistory.counters[FilesProcessed],
 			totalhistory.counters[DirectoriesProcessed])
 		logger.Warn().Msgf("Deleted %v", totalhistory.counters[EntriesDeleted])
+		if *dryrun {
+			logger.Warn().Msg(c.DryRunSummary())
+		}
+		err = c.ChangeLog.Close()
+		if err != nil {
+			logger.Error().Msgf("Error closing changelog: %v", err)
+		}
+		if dryrunlistwriter != nil {
+			dryrunlistwriter.Flush()
+			dryrunlistfile.Close()
+		}
+		if differences > 0 {
+			os.Exit(1)
+		}
 
 	default:
 		logger.Fatal().Msgf("Invalid mode: %v", pflag.Arg(0))
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"github.com/cespare/xxhash/v2"
+)
+
+// ConnectionPool spreads RPC calls over several connections to the same
+// server, each with its own compression and codec. Calls for the same path
+// always go over the same connection, so open files stay on one connection.
+type ConnectionPool struct {
+	clients []*RPCClient
+}
+
+// DialPool opens count connections using dial
+func DialPool(count int, dial func() (*RPCClient, error)) (*ConnectionPool, error) {
+	if count < 1 {
+		count = 1
+	}
+	cp := &ConnectionPool{}
+	for i := 0; i < count; i++ {
+		client, err := dial()
+		if err != nil {
+			cp.Close()
+			return nil, err
+		}
+		cp.clients = append(cp.clients, client)
+	}
+	return cp, nil
+}
+
+// For returns the connection to use for calls about path
+func (cp *ConnectionPool) For(path string) *RPCClient {
+	if len(cp.clients) == 1 {
+		return cp.clients[0]
+	}
+	return cp.clients[xxhash.Sum64String(path)%uint64(len(cp.clients))]
+}
+
+func (cp *ConnectionPool) Len() int {
+	return len(cp.clients)
+}
+
+func (cp *ConnectionPool) Close() error {
+	var firsterr error
+	for _, client := range cp.clients {
+		err := client.Close()
+		if err != nil && firsterr == nil {
+			firsterr = err
+		}
+	}
+	return firsterr
+}
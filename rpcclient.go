@@ -0,0 +1,328 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/rpc"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// how long to wait before reconnecting, doubled for each failed attempt
+const (
+	reconnectDelay    = time.Second
+	reconnectMaxDelay = time.Minute
+)
+
+// how often TCP checks that the other side is still there when idle
+const tcpKeepAlive = 15 * time.Second
+
+var ErrTimeout = errors.New("no response from server")
+
+// calls that can be sent again after the connection broke, as doing them
+// twice gives the same result. Calls on open files are retried by the file,
+// as they need the file to be opened again first.
+var retryableCalls = map[string]bool{
+	"Server.Hello":        true,
+	"Server.Stat":         true,
+	"Server.List":         true,
+	"Server.ReadDir":      true,
+	"Server.Open":         true,
+	"Server.OpenWrite":    true,
+	"Server.Mkdir":        true,
+	"Server.Truncate":     true,
+	"Server.ApplyChanges": true,
+	"Server.LookupID":     true,
+}
+
+// isConnectionError is true for errors where we don't know if the server got
+// the call, as opposed to the server returning an error
+func isConnectionError(err error) bool {
+	if err == nil {
+		return false
+	}
+	var serr rpc.ServerError
+	return !errors.As(err, &serr)
+}
+
+// trackingCodec keeps track of calls waiting for a response, so a connection
+// where nothing comes back can be detected without limiting how long a single
+// call can take on a slow link
+type trackingCodec struct {
+	rpc.ClientCodec
+	pending  atomic.Int64
+	lastseen atomic.Int64 // unix nanoseconds of the last response, or of the first call after being idle
+}
+
+func (tc *trackingCodec) WriteRequest(r *rpc.Request, body any) error {
+	if tc.pending.Add(1) == 1 {
+		tc.lastseen.Store(time.Now().UnixNano())
+	}
+	return tc.ClientCodec.WriteRequest(r, body)
+}
+
+func (tc *trackingCodec) ReadResponseHeader(r *rpc.Response) error {
+	err := tc.ClientCodec.ReadResponseHeader(r)
+	if err == nil {
+		tc.lastseen.Store(time.Now().UnixNano())
+		tc.pending.Add(-1)
+	}
+	return err
+}
+
+// hung returns true if calls have been waiting longer than timeout without
+// anything coming back
+func (tc *trackingCodec) hung(timeout time.Duration) bool {
+	return tc.pending.Load() > 0 && time.Since(time.Unix(0, tc.lastseen.Load())) > timeout
+}
+
+// RPCClient is a connection to the server that is re-established when it
+// breaks. Every new connection gets a new generation, so files opened on the
+// old one know they have to be opened again.
+type RPCClient struct {
+	dial    func() (rpc.ClientCodec, error)
+	retries int
+	timeout time.Duration
+
+	lock       sync.Mutex
+	client     *rpc.Client
+	codec      *trackingCodec
+	generation uint64
+	giveup     error // set when reconnecting failed, so we don't keep trying
+	closed     bool
+}
+
+// DialRPCClient connects using dial, and will try reconnecting up to retries
+// times when the connection breaks. Connections where calls get no response
+// for timeout are considered broken, zero disables this.
+func DialRPCClient(dial func() (rpc.ClientCodec, error), retries int, timeout time.Duration) (*RPCClient, error) {
+	rc := &RPCClient{
+		dial:    dial,
+		retries: retries,
+		timeout: timeout,
+	}
+	codec, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	rc.use(codec)
+	if timeout > 0 {
+		go rc.watchdog()
+	}
+	return rc, nil
+}
+
+func (rc *RPCClient) use(codec rpc.ClientCodec) {
+	rc.codec = &trackingCodec{ClientCodec: codec}
+	rc.client = rpc.NewClientWithCodec(rc.codec)
+}
+
+func (rc *RPCClient) watchdog() {
+	for range time.Tick(rc.timeout / 4) {
+		rc.lock.Lock()
+		if rc.closed {
+			rc.lock.Unlock()
+			return
+		}
+		codec, generation := rc.codec, rc.generation
+		rc.lock.Unlock()
+		if codec != nil && codec.hung(rc.timeout) {
+			rc.failed(generation, ErrTimeout)
+		}
+	}
+}
+
+// connection returns the current connection, reconnecting if it's broken
+func (rc *RPCClient) connection() (*rpc.Client, uint64, error) {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	if rc.closed {
+		return nil, rc.generation, rpc.ErrShutdown
+	}
+	if rc.client != nil {
+		return rc.client, rc.generation, nil
+	}
+	if rc.giveup != nil {
+		return nil, rc.generation, rc.giveup
+	}
+
+	delay := reconnectDelay
+	var err error
+	for attempt := 1; attempt <= rc.retries; attempt++ {
+		logger.Warn().Msgf("Reconnecting to server in %v (attempt %v of %v)", delay, attempt, rc.retries)
+		time.Sleep(delay)
+		var codec rpc.ClientCodec
+		codec, err = rc.dial()
+		if err == nil {
+			logger.Info().Msg("Reconnected to server")
+			rc.use(codec)
+			return rc.client, rc.generation, nil
+		}
+		logger.Warn().Msgf("Reconnecting failed: %v", err)
+		delay = min(delay*2, reconnectMaxDelay)
+	}
+	if err == nil {
+		err = errors.New("reconnecting is disabled")
+	}
+	rc.giveup = fmt.Errorf("connection to server lost: %w", err)
+	return nil, rc.generation, rc.giveup
+}
+
+// failed drops the connection of the given generation after an error on it, if
+// that hasn't been done already
+func (rc *RPCClient) failed(generation uint64, err error) {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	if rc.generation != generation || rc.client == nil {
+		return
+	}
+	logger.Warn().Msgf("Connection to server broke: %v", err)
+	rc.client.Close()
+	rc.client = nil
+	rc.codec = nil
+	rc.generation++
+}
+
+// Generation changes whenever the connection breaks
+func (rc *RPCClient) Generation() uint64 {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	return rc.generation
+}
+
+// call does a call and returns the generation of the connection it was done
+// on. If retry is set, calls lost with the connection are sent again.
+func (rc *RPCClient) call(method string, args any, reply any, retry bool) (uint64, error) {
+	for attempt := 0; ; attempt++ {
+		client, generation, err := rc.connection()
+		if err != nil {
+			return generation, err
+		}
+		err = client.Call(method, args, reply)
+		if !isConnectionError(err) {
+			return generation, err
+		}
+		rc.failed(generation, err)
+		if !retry || attempt >= rc.retries {
+			return generation, err
+		}
+		logger.Debug().Msgf("Retrying %v after connection error: %v", method, err)
+	}
+}
+
+// Call works like rpc.Client.Call, and retries calls that are safe to repeat
+// if the connection breaks
+func (rc *RPCClient) Call(method string, args any, reply any) error {
+	_, err := rc.call(method, args, reply, retryableCalls[method])
+	return err
+}
+
+// Go starts a call without retrying it, and returns the generation of the
+// connection so the caller can report a broken connection with failed
+func (rc *RPCClient) Go(method string, args any, reply any) (*rpc.Call, uint64) {
+	client, generation, err := rc.connection()
+	if err != nil {
+		call := &rpc.Call{
+			ServiceMethod: method,
+			Args:          args,
+			Reply:         reply,
+			Error:         err,
+			Done:          make(chan *rpc.Call, 1),
+		}
+		call.Done <- call
+		return call, generation
+	}
+	return client.Go(method, args, reply, nil), generation
+}
+
+func (rc *RPCClient) Close() error {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	rc.closed = true
+	if rc.client == nil {
+		return nil
+	}
+	return rc.client.Close()
+}
+
+// remoteHandle is a file opened on the server, which is opened again if the
+// connection was re-established since
+type remoteHandle struct {
+	client     *RPCClient
+	path       string
+	openmethod string
+
+	lock       sync.Mutex
+	handle     uint64
+	generation uint64
+	size       int64
+}
+
+func openRemoteHandle(client *RPCClient, openmethod, path string) (*remoteHandle, error) {
+	rh := &remoteHandle{
+		client:     client,
+		path:       path,
+		openmethod: openmethod,
+	}
+	rh.lock.Lock()
+	defer rh.lock.Unlock()
+	return rh, rh.open()
+}
+
+func (rh *remoteHandle) open() error {
+	var reply OpenReply
+	generation, err := rh.client.call(rh.openmethod, rh.path, &reply, true)
+	if err != nil {
+		return rpcError(err, rh.path)
+	}
+	rh.handle = reply.Handle
+	rh.generation = generation
+	rh.size = reply.Size
+	return nil
+}
+
+// current returns the handle to use on the current connection
+func (rh *remoteHandle) current() (uint64, uint64, error) {
+	rh.lock.Lock()
+	defer rh.lock.Unlock()
+	if rh.generation != rh.client.Generation() {
+		logger.Debug().Msgf("Opening %s again after reconnecting", rh.path)
+		err := rh.open()
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	return rh.handle, rh.generation, nil
+}
+
+// call does a call on the file, where args builds the arguments for the
+// current handle, and retries it if the connection breaks
+func (rh *remoteHandle) call(method string, args func() (any, error), reply any) error {
+	for attempt := 0; ; attempt++ {
+		a, err := args()
+		if err != nil {
+			return err
+		}
+		_, err = rh.client.call(method, a, reply, false)
+		if !isConnectionError(err) || attempt >= rh.client.retries {
+			return rpcError(err, rh.path)
+		}
+		logger.Debug().Msgf("Retrying %v on %s after connection error: %v", method, rh.path, err)
+	}
+}
+
+// close closes the file, unless the connection it was opened on is gone, as
+// the server closes files when the client disconnects
+func (rh *remoteHandle) close() error {
+	rh.lock.Lock()
+	defer rh.lock.Unlock()
+	if rh.generation != rh.client.Generation() {
+		return nil
+	}
+	_, err := rh.client.call("Server.Close", rh.handle, nil, false)
+	if isConnectionError(err) {
+		return nil
+	}
+	return rpcError(err, rh.path)
+}
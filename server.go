@@ -2,29 +2,47 @@ package main
 
 import (
 	"errors"
+	"io"
 	"os"
 	"path/filepath"
-	"strings"
+	"sync/atomic"
 
 	"github.com/cespare/xxhash/v2"
-	"github.com/lkarlslund/gonk"
 )
 
-type filehandleindex struct {
-	name string
-	fh   *os.File
-}
+var ErrReadOnly = errors.New("server is read only, start it with --writable to allow pushing")
 
-func (fhi filehandleindex) Compare(fhi2 filehandleindex) int {
-	return strings.Compare(fhi.name, fhi2.name)
-}
+var ErrChunkTooLarge = errors.New("chunk or block size is larger than the server allows")
+
+// the largest chunk or block size a client can ask for, so a bad request
+// can't make the server allocate without limit
+const maxChunkSize = 64 * 1024 * 1024
 
 type Server struct {
-	BasePath string
-	ReadOnly bool
+	BasePath      string
+	ReadOnly      bool
+	MaxOpenFiles  int            // for all connections together, no limit if zero
+	PreserveAtime bool           // read files without changing their access times
+	Options       CompareOptions // inode flags and fake super on this side
 
-	shutdown chan struct{}
-	files    gonk.Gonk[filehandleindex]
+	root      *PathConfiner
+	shutdown  chan struct{}
+	openfiles atomic.Int64
+}
+
+func NewServer(basepath string, readonly bool) *Server {
+	return &Server{
+		BasePath: basepath,
+		ReadOnly: readonly,
+		root:     NewPathConfiner(basepath),
+		shutdown: make(chan struct{}),
+	}
+}
+
+// DirEntry is the lightweight listing used when deciding what to delete
+type DirEntry struct {
+	Name  string
+	IsDir bool
 }
 
 type FileListResponse struct {
@@ -46,18 +64,24 @@ func (s *Server) List(path string, reply *FileListResponse) error {
 	var flr FileListResponse
 	flr.ParentDirectory = path
 
-	entries, err := os.ReadDir(filepath.Join(s.BasePath, path))
+	dir, times, err := s.openRead(path)
+	if err != nil {
+		return err
+	}
+	defer closeRead(dir, times)
+	entries, err := dir.ReadDir(-1)
 	if err != nil {
 		return err
 	}
 	for _, d := range entries {
-		absolutepath := filepath.Join(s.BasePath, path, d.Name())
+		// looked up through the open directory, so it can't be swapped
+		absolutepath := entryPath(dir, d.Name())
 		relativepath := filepath.Join(path, d.Name())
 		info, err := d.Info()
 		if err != nil {
 			return err
 		}
-		fi, err := InfoToFileInfo(info, absolutepath)
+		fi, err := InfoToFileInfo(info, absolutepath, s.Options)
 		if err != nil {
 			return err
 		}
@@ -72,14 +96,19 @@ func (s *Server) List(path string, reply *FileListResponse) error {
 func (s *Server) Stat(path string, reply *FileInfo) error {
 	logger.Trace().Msgf("Stat entry %s", path)
 
-	absolutepath := filepath.Join(s.BasePath, path)
+	parent, err := s.root.Parent(path)
+	if err != nil {
+		return err
+	}
+	defer parent.Close()
+	absolutepath := parent.Path()
 	relativepath := path
 
 	info, err := os.Lstat(absolutepath)
 	if err != nil {
 		return err
 	}
-	fi, err := InfoToFileInfo(info, absolutepath)
+	fi, err := InfoToFileInfo(info, absolutepath, s.Options)
 	// Override path to only send the relative path
 	fi.Name = relativepath
 	*reply = fi
@@ -87,80 +116,267 @@ func (s *Server) Stat(path string, reply *FileInfo) error {
 }
 
 type GetChunkArgs struct {
-	Path   string
+	Handle uint64
 	Offset uint64
 	Size   uint64
 }
 
-func (s *Server) Open(path string, reply *interface{}) error {
-	logger.Trace().Msgf("Opening file %s", path)
-	h, err := os.Open(filepath.Join(s.BasePath, path))
+type ChecksumFileArgs struct {
+	Handle    uint64
+	BlockSize int64
+}
+
+type ChecksumRangeArgs struct {
+	Handle       uint64
+	BlockSize    int64
+	Offset, Size int64
+}
+
+// ChecksumBlocks hashes the blocks in [offset, offset+size) with one
+// sequential read, where the last block can be short
+func ChecksumBlocks(r io.ReaderAt, offset, size, blocksize int64) ([]uint64, error) {
+	if blocksize <= 0 || size < 0 {
+		return nil, errors.New("invalid block size or range")
+	}
+	if blocksize > maxChunkSize {
+		return nil, ErrChunkTooLarge
+	}
+	// room for what a sync asks for at once, more just grows it
+	hashes := make([]uint64, 0, min((size+blocksize-1)/blocksize, checksumBlocksPerRequest))
+	buf := make([]byte, blocksize)
+	for done := int64(0); done < size; done += blocksize {
+		data := buf[:min(blocksize, size-done)]
+		n, err := r.ReadAt(data, offset+done)
+		if err != nil && (err != io.EOF || n != len(data)) {
+			return hashes, err
+		}
+		hashes = append(hashes, xxhash.Sum64(data))
+	}
+	return hashes, nil
+}
+
+func (s *Server) ReadDir(path string, reply *[]DirEntry) error {
+	logger.Trace().Msgf("Reading directory entries in %s", path)
+	dir, err := s.root.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	entries, err := dir.ReadDir(-1)
 	if err != nil {
 		return err
 	}
-	s.files.Store(
-		filehandleindex{
-			name: path,
-			fh:   h,
-		},
-	)
+	result := make([]DirEntry, len(entries))
+	for i, entry := range entries {
+		result[i] = DirEntry{
+			Name:  entry.Name(),
+			IsDir: entry.IsDir(),
+		}
+	}
+	*reply = result
 	return nil
 }
 
-func (s *Server) GetChunk(args GetChunkArgs, data *[]byte) error {
-	logger.Trace().Msgf("Getting chunk from file %s at offset %d size %d", args.Path, args.Offset, args.Size)
-	fi, found := s.files.Load(filehandleindex{
-		name: args.Path,
-	})
-	if !found {
-		return errors.New("file handle not found")
+// Write side RPCs used when a client is pushing to us
+
+type FileInfoArgs struct {
+	Path    string
+	Info    FileInfo
+	Options CompareOptions // for ApplyChanges
+}
+
+type WriteChunkArgs struct {
+	Handle uint64
+	Offset uint64
+	Data   []byte
+}
+
+type TruncateArgs struct {
+	Path string
+	Size int64
+}
+
+type LinkArgs struct {
+	OldPath, NewPath string
+}
+
+type RenameArgs struct {
+	OldPath, NewPath string
+}
+
+type CopyChunkArgs struct {
+	From, To   uint64 // handles
+	FromOffset uint64
+	Offset     uint64
+	Size       uint64
+}
+
+type DeleteArgs struct {
+	Path      string
+	Recursive bool
+}
+
+func (s *Server) Mkdir(path string, reply *interface{}) error {
+	if s.ReadOnly {
+		return ErrReadOnly
+	}
+	logger.Trace().Msgf("Creating directory %s", path)
+	parent, err := s.root.Parent(path)
+	if os.IsNotExist(err) && filepath.Dir(path) != path {
+		// create the missing directories above it first
+		err = s.Mkdir(filepath.Dir(path), reply)
+		if err != nil {
+			return err
+		}
+		parent, err = s.root.Parent(path)
 	}
-	d := make([]byte, args.Size)
-	n, err := fi.fh.ReadAt(d, int64(args.Offset))
 	if err != nil {
 		return err
 	}
-	if n != int(args.Size) {
-		return errors.New("end of file reached")
+	defer parent.Close()
+	err = os.Mkdir(parent.Path(), 0755)
+	if os.IsExist(err) {
+		if info, staterr := os.Lstat(parent.Path()); staterr == nil && info.IsDir() {
+			return nil
+		}
 	}
-	*data = d
-	return nil
+	return err
 }
 
-func (s *Server) ChecksumChunk(args GetChunkArgs, checksum *uint64) error {
-	logger.Trace().Msgf("Checksumming chunk from file %s at offset %d size %d", args.Path, args.Offset, args.Size)
-	fi, found := s.files.Load(filehandleindex{
-		name: args.Path,
-	})
-	if !found {
-		return errors.New("file handle not found")
+func (s *Server) Create(args FileInfoArgs, reply *interface{}) error {
+	if s.ReadOnly {
+		return ErrReadOnly
 	}
-	data := make([]byte, args.Size)
-	n, err := fi.fh.ReadAt(data, int64(args.Offset))
+	logger.Trace().Msgf("Creating file %s", args.Path)
+	if args.Info.Mode.IsRegular() {
+		// never follow a symlink that's already there
+		h, err := s.root.OpenFile(args.Path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+		if err != nil {
+			return err
+		}
+		return h.Close()
+	}
+	parent, err := s.root.Parent(args.Path)
 	if err != nil {
 		return err
 	}
-	if n != int(args.Size) {
-		return errors.New("end of file reached")
+	defer parent.Close()
+	return FileInfo{Name: parent.Path()}.Create(args.Info, s.Options)
+}
+
+func (s *Server) Truncate(args TruncateArgs, reply *interface{}) error {
+	if s.ReadOnly {
+		return ErrReadOnly
 	}
-	cs := xxhash.Sum64(data)
-	*checksum = cs
-	return nil
+	logger.Trace().Msgf("Truncating file %s to %d bytes", args.Path, args.Size)
+	h, err := s.root.OpenFile(args.Path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+	return h.Truncate(args.Size)
+}
+
+func (s *Server) ApplyChanges(args FileInfoArgs, reply *interface{}) error {
+	if s.ReadOnly {
+		return ErrReadOnly
+	}
+	logger.Trace().Msgf("Applying metadata to %s", args.Path)
+	parent, err := s.root.Parent(args.Path)
+	if err != nil {
+		return err
+	}
+	defer parent.Close()
+	fi, err := PathToFileInfo(parent.Path(), s.Options)
+	if err != nil {
+		return err
+	}
+	if fi.Mode&os.ModeSymlink != args.Info.Mode&os.ModeSymlink {
+		// chmod and ACLs follow symlinks
+		return ErrTypeError
+	}
+	// we only know the flags of our entries if we were started with them
+	options := args.Options
+	options.InodeFlags = options.InodeFlags && s.Options.InodeFlags
+	options.FakeSuper = s.Options.FakeSuper
+	return fi.ApplyChanges(args.Info, options)
+}
+
+func (s *Server) Link(args LinkArgs, reply *interface{}) error {
+	if s.ReadOnly {
+		return ErrReadOnly
+	}
+	logger.Trace().Msgf("Hardlinking %s to %s", args.NewPath, args.OldPath)
+	oldparent, err := s.root.Parent(args.OldPath)
+	if err != nil {
+		return err
+	}
+	defer oldparent.Close()
+	newparent, err := s.root.Parent(args.NewPath)
+	if err != nil {
+		return err
+	}
+	defer newparent.Close()
+	return os.Link(oldparent.Path(), newparent.Path())
 }
 
-func (s *Server) Close(path string, reply *interface{}) error {
-	logger.Trace().Msgf("Closing file %s", path)
-	fi, found := s.files.Load(filehandleindex{
-		name: path,
-	})
-	if !found {
-		return errors.New("file handle not found")
+// CreateTemp creates an empty file next to path for building a replacement
+// for it, and returns the path of it
+func (s *Server) CreateTemp(path string, temppath *string) error {
+	if s.ReadOnly {
+		return ErrReadOnly
 	}
-	s.files.Delete(fi)
-	fi.fh.Close()
+	logger.Trace().Msgf("Creating temporary file for %s", path)
+	parent, err := s.root.Parent(path)
+	if err != nil {
+		return err
+	}
+	defer parent.Close()
+	name, err := createTempSibling(parent.Path())
+	if err != nil {
+		return err
+	}
+	*temppath = filepath.Join(filepath.Dir(path), name)
 	return nil
 }
 
+func (s *Server) Rename(args RenameArgs, reply *interface{}) error {
+	if s.ReadOnly {
+		return ErrReadOnly
+	}
+	logger.Trace().Msgf("Renaming %s to %s", args.OldPath, args.NewPath)
+	oldparent, err := s.root.Parent(args.OldPath)
+	if err != nil {
+		return err
+	}
+	defer oldparent.Close()
+	newparent, err := s.root.Parent(args.NewPath)
+	if err != nil {
+		return err
+	}
+	defer newparent.Close()
+	return os.Rename(oldparent.Path(), newparent.Path())
+}
+
+func (s *Server) Delete(args DeleteArgs, reply *interface{}) error {
+	if s.ReadOnly {
+		return ErrReadOnly
+	}
+	logger.Trace().Msgf("Deleting %s", args.Path)
+	parent, err := s.root.Parent(args.Path)
+	if err != nil {
+		return err
+	}
+	defer parent.Close()
+	if parent.IsBase() {
+		return errors.New("refusing to delete the root directory")
+	}
+	if args.Recursive {
+		return os.RemoveAll(parent.Path())
+	}
+	return os.Remove(parent.Path())
+}
+
 func (s *Server) Wait() {
 	<-s.shutdown
 }
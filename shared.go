@@ -2,43 +2,13 @@ package main
 
 import (
 	"io"
+	"io/fs"
+	"net/rpc"
+	"strings"
 	"sync/atomic"
-
-	"github.com/klauspost/compress/s2"
+	"syscall"
 )
 
-type compressedConn struct {
-	r *s2.Reader
-	w *s2.Writer
-	c io.Closer
-}
-
-func CompressedReadWriteCloser(rwc io.ReadWriteCloser) io.ReadWriteCloser {
-	r := s2.NewReader(rwc)
-	w := s2.NewWriter(rwc, s2.WriterFlushOnWrite())
-	return &compressedConn{
-		r,
-		w,
-		rwc,
-	}
-}
-
-func (c *compressedConn) Read(p []byte) (n int, err error) {
-	n, err = c.r.Read(p)
-	return
-}
-
-func (c *compressedConn) Write(p []byte) (n int, err error) {
-	n, err = c.w.Write(p)
-	return
-}
-
-func (c *compressedConn) Close() (err error) {
-	c.w.Close()
-	err = c.c.Close()
-	return
-}
-
 // performance related stuff
 type PerformanceCounterType int
 
@@ -113,13 +83,24 @@ var p = NewPerformance()
 type PerformanceWrapperReadWriteCloser struct {
 	onWrite, onRead AtomicAdder
 	rwc             io.ReadWriteCloser
+	limiter         *BandwidthLimiter
 }
 
+// NewPerformanceWrapper counts the bytes read with onRead and the bytes written
+// with onWrite. The fields are named as the struct has them in the opposite
+// order, which used to swap the sent and received statistics.
 func NewPerformanceWrapper(rwc io.ReadWriteCloser, onRead, onWrite AtomicAdder) *PerformanceWrapperReadWriteCloser {
-	return &PerformanceWrapperReadWriteCloser{onRead, onWrite, rwc}
+	return &PerformanceWrapperReadWriteCloser{onRead: onRead, onWrite: onWrite, rwc: rwc}
+}
+
+// SetLimiter limits the bandwidth going through, use it on the wrapper closest
+// to the wire so it counts the bytes after compression
+func (pw *PerformanceWrapperReadWriteCloser) SetLimiter(limiter *BandwidthLimiter) {
+	pw.limiter = limiter
 }
 
 func (pw *PerformanceWrapperReadWriteCloser) Write(b []byte) (int, error) {
+	pw.limiter.WaitWrite(len(b))
 	n, err := pw.rwc.Write(b)
 	pw.onWrite(uint64(n))
 	return n, err
@@ -128,9 +109,37 @@ func (pw *PerformanceWrapperReadWriteCloser) Write(b []byte) (int, error) {
 func (pw *PerformanceWrapperReadWriteCloser) Read(b []byte) (int, error) {
 	n, err := pw.rwc.Read(b)
 	pw.onRead(uint64(n))
+	pw.limiter.WaitRead(n)
 	return n, err
 }
 
+// Flush passes on to the wrapped connection, so the RPC codec sends a whole
+// message at a time
+func (pw *PerformanceWrapperReadWriteCloser) Flush() error {
+	if f, ok := pw.rwc.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
 func (pw *PerformanceWrapperReadWriteCloser) Close() error {
 	return pw.rwc.Close()
 }
+
+// rpcError turns well known errors that have been flattened to strings by
+// net/rpc back into errors that os.IsNotExist and friends understand
+func rpcError(err error, path string) error {
+	serr, ok := err.(rpc.ServerError)
+	if !ok {
+		return err
+	}
+	switch {
+	case string(serr) == ErrNotSupportedByPlatform.Error():
+		return ErrNotSupportedByPlatform
+	case strings.HasSuffix(string(serr), syscall.ENOENT.Error()):
+		return &fs.PathError{Op: "remote", Path: path, Err: syscall.ENOENT}
+	case strings.HasSuffix(string(serr), syscall.EEXIST.Error()):
+		return &fs.PathError{Op: "remote", Path: path, Err: syscall.EEXIST}
+	}
+	return err
+}
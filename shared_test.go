@@ -0,0 +1,34 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+type bufferCloser struct {
+	bytes.Buffer
+}
+
+func (bc *bufferCloser) Close() error {
+	return nil
+}
+
+func TestPerformanceWrapperCounters(t *testing.T) {
+	var read, written uint64
+	buffer := &bufferCloser{}
+	buffer.WriteString("to be read")
+	pw := NewPerformanceWrapper(buffer,
+		func(n uint64) { read += n },
+		func(n uint64) { written += n },
+	)
+	if _, err := pw.Write([]byte("written")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(pw); err != nil {
+		t.Fatal(err)
+	}
+	if read != uint64(len("to be readwritten")) || written != uint64(len("written")) {
+		t.Errorf("read %v and wrote %v bytes, expected %v and %v", read, written, len("to be readwritten"), len("written"))
+	}
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"net/rpc"
+	"sync"
+)
+
+// Source is the side of a sync that files are read from
+type Source interface {
+	Stat(path string) (FileInfo, error)
+	List(path string) ([]FileInfo, error)
+	Open(path string) (SourceFile, error)
+	// Hash returns the strong hash of a whole file for verification
+	Hash(path, algorithm string) (string, error)
+}
+
+// SourceFile is a file on the source opened for reading
+type SourceFile interface {
+	ChecksumFile(blocksize int64) ([]uint64, error)
+	// ChecksumRange hashes the blocks in [offset, offset+size)
+	ChecksumRange(offset, size, blocksize int64) ([]uint64, error)
+	Delta(args DeltaArgs) (DeltaResponse, error)
+	// Extents returns the parts of the file that have data
+	Extents() ([]Extent, error)
+	// Stream fetches the chunks in the background, keeping up to window of
+	// them in flight
+	Stream(chunks []GetChunkArgs, window int) *ChunkStream
+	Close() error
+}
+
+// StreamChunk is one block of a file delivered by a ChunkStream
+type StreamChunk struct {
+	Offset int64
+	Data   []byte
+	Err    error
+}
+
+// ChunkStream delivers chunks of a file in the order they were requested. It
+// ends after the last chunk or the first error.
+type ChunkStream struct {
+	chunks chan StreamChunk
+	done   chan struct{}
+	once   sync.Once
+}
+
+func newChunkStream(buffer int) *ChunkStream {
+	return &ChunkStream{
+		chunks: make(chan StreamChunk, buffer),
+		done:   make(chan struct{}),
+	}
+}
+
+func (cs *ChunkStream) Next() (StreamChunk, bool) {
+	chunk, ok := <-cs.chunks
+	return chunk, ok
+}
+
+// Close stops fetching more chunks, and must be called even if the stream
+// was read to the end
+func (cs *ChunkStream) Close() {
+	cs.once.Do(func() {
+		close(cs.done)
+	})
+	for range cs.chunks {
+		// wait for the fetcher to give up
+	}
+}
+
+// deliver hands a chunk to the reader, returning false if the stream was closed
+func (cs *ChunkStream) deliver(chunk StreamChunk) bool {
+	select {
+	case cs.chunks <- chunk:
+		return true
+	case <-cs.done:
+		return false
+	}
+}
+
+// RemoteSource reads files from a fastsync server (pull mode)
+type RemoteSource struct {
+	pool *ConnectionPool
+}
+
+func NewRemoteSource(pool *ConnectionPool) *RemoteSource {
+	return &RemoteSource{
+		pool: pool,
+	}
+}
+
+func (rs *RemoteSource) Stat(path string) (FileInfo, error) {
+	var fi FileInfo
+	err := rs.pool.For(path).Call("Server.Stat", path, &fi)
+	return fi, rpcError(err, path)
+}
+
+func (rs *RemoteSource) List(path string) ([]FileInfo, error) {
+	var flr FileListResponse
+	err := rs.pool.For(path).Call("Server.List", path, &flr)
+	return flr.Files, rpcError(err, path)
+}
+
+func (rs *RemoteSource) Hash(path, algorithm string) (string, error) {
+	return hashRemote(rs.pool.For(path), path, algorithm)
+}
+
+func (rs *RemoteSource) Open(path string) (SourceFile, error) {
+	rh, err := openRemoteHandle(rs.pool.For(path), "Server.Open", path)
+	if err != nil {
+		return nil, err
+	}
+	return &remoteSourceFile{
+		remoteHandle: rh,
+	}, nil
+}
+
+// remoteSourceFile is a file opened on the server, which is only known on the
+// connection that opened it
+type remoteSourceFile struct {
+	*remoteHandle
+
+	// the server forgets the delta signature with the connection, so we keep
+	// it to send it again after reconnecting
+	signature     *Signature
+	signaturesent uint64 // generation of the connection it was sent on
+}
+
+func (rsf *remoteSourceFile) ChecksumFile(blocksize int64) ([]uint64, error) {
+	var hashes []uint64
+	err := rsf.call("Server.ChecksumFile", func() (any, error) {
+		handle, _, err := rsf.current()
+		return ChecksumFileArgs{
+			Handle:    handle,
+			BlockSize: blocksize,
+		}, err
+	}, &hashes)
+	return hashes, err
+}
+
+func (rsf *remoteSourceFile) ChecksumRange(offset, size, blocksize int64) ([]uint64, error) {
+	var hashes []uint64
+	err := rsf.call("Server.ChecksumRange", func() (any, error) {
+		handle, _, err := rsf.current()
+		return ChecksumRangeArgs{
+			Handle:    handle,
+			BlockSize: blocksize,
+			Offset:    offset,
+			Size:      size,
+		}, err
+	}, &hashes)
+	return hashes, err
+}
+
+func (rsf *remoteSourceFile) Delta(args DeltaArgs) (DeltaResponse, error) {
+	if args.Signature != nil {
+		rsf.signature = args.Signature
+	}
+	var response DeltaResponse
+	err := rsf.call("Server.Delta", func() (any, error) {
+		handle, generation, err := rsf.current()
+		callargs := args
+		callargs.Handle = handle
+		if rsf.signature != nil && (callargs.Signature != nil || rsf.signaturesent != generation) {
+			callargs.Signature = rsf.signature
+			rsf.signaturesent = generation
+		}
+		return callargs, err
+	}, &response)
+	return response, err
+}
+
+func (rsf *remoteSourceFile) Extents() ([]Extent, error) {
+	var extents []Extent
+	err := rsf.call("Server.Extents", func() (any, error) {
+		handle, _, err := rsf.current()
+		return handle, err
+	}, &extents)
+	return extents, err
+}
+
+// Stream pipelines GetChunk calls, so the transfer isn't bound by the round
+// trip time. A new call is only sent when a chunk has been handed over, which
+// keeps the server from sending more than we can write. If the connection
+// breaks, fetching starts over from the first chunk not delivered yet.
+func (rsf *remoteSourceFile) Stream(chunks []GetChunkArgs, window int) *ChunkStream {
+	if window < 1 {
+		window = 1
+	}
+	type pending struct {
+		call       *rpc.Call
+		index      int
+		generation uint64
+	}
+	cs := newChunkStream(0)
+	go func() {
+		defer close(cs.chunks)
+		var inflight []pending
+		wait := func() {
+			for _, p := range inflight {
+				<-p.call.Done
+			}
+			inflight = nil
+		}
+		defer wait()
+		var next, retries int
+		for {
+			for len(inflight) < window && next < len(chunks) {
+				handle, generation, err := rsf.current()
+				if err != nil {
+					cs.deliver(StreamChunk{
+						Offset: int64(chunks[next].Offset),
+						Err:    err,
+					})
+					return
+				}
+				args := chunks[next]
+				args.Handle = handle
+				call, _ := rsf.client.Go("Server.GetChunk", args, new([]byte))
+				inflight = append(inflight, pending{
+					call:       call,
+					index:      next,
+					generation: generation,
+				})
+				next++
+			}
+			if len(inflight) == 0 {
+				return
+			}
+			p := inflight[0]
+			inflight = inflight[1:]
+			<-p.call.Done
+			if isConnectionError(p.call.Error) {
+				rsf.client.failed(p.generation, p.call.Error)
+			}
+			if isConnectionError(p.call.Error) && retries < rsf.client.retries {
+				retries++
+				logger.Debug().Msgf("Fetching %s again from offset %v after connection error: %v", rsf.path, chunks[p.index].Offset, p.call.Error)
+				wait()
+				next = p.index
+				continue
+			}
+			chunk := StreamChunk{
+				Offset: int64(p.call.Args.(GetChunkArgs).Offset),
+				Data:   *p.call.Reply.(*[]byte),
+				Err:    rpcError(p.call.Error, rsf.path),
+			}
+			if !cs.deliver(chunk) || chunk.Err != nil {
+				return
+			}
+			retries = 0
+		}
+	}()
+	return cs
+}
+
+func (rsf *remoteSourceFile) Close() error {
+	return rsf.close()
+}
+
+// LocalSource reads files from the local filesystem (push mode), using the
+// same code as the server does for serving files
+type LocalSource struct {
+	conn *Connection
+}
+
+func NewLocalSource(basepath string) *LocalSource {
+	return &LocalSource{
+		conn: NewConnection(NewServer(basepath, true)),
+	}
+}
+
+func (ls *LocalSource) Stat(path string) (FileInfo, error) {
+	var fi FileInfo
+	err := ls.conn.Stat(path, &fi)
+	return fi, err
+}
+
+func (ls *LocalSource) List(path string) ([]FileInfo, error) {
+	var flr FileListResponse
+	err := ls.conn.List(path, &flr)
+	return flr.Files, err
+}
+
+func (ls *LocalSource) Hash(path, algorithm string) (string, error) {
+	return ls.conn.hashPath(path, algorithm)
+}
+
+func (ls *LocalSource) Open(path string) (SourceFile, error) {
+	var reply OpenReply
+	err := ls.conn.Open(path, &reply)
+	if err != nil {
+		return nil, err
+	}
+	return &localSourceFile{
+		conn:   ls.conn,
+		handle: reply.Handle,
+	}, nil
+}
+
+type localSourceFile struct {
+	conn   *Connection
+	handle uint64
+}
+
+func (lsf *localSourceFile) getChunk(args GetChunkArgs) ([]byte, error) {
+	var data []byte
+	args.Handle = lsf.handle
+	err := lsf.conn.GetChunk(args, &data)
+	if err == nil {
+		p.Add(ReadBytes, uint64(len(data)))
+	}
+	return data, err
+}
+
+func (lsf *localSourceFile) ChecksumFile(blocksize int64) ([]uint64, error) {
+	var hashes []uint64
+	err := lsf.conn.ChecksumFile(ChecksumFileArgs{
+		Handle:    lsf.handle,
+		BlockSize: blocksize,
+	}, &hashes)
+	if err == nil {
+		p.Add(ReadBytes, uint64(len(hashes))*uint64(blocksize))
+	}
+	return hashes, err
+}
+
+func (lsf *localSourceFile) ChecksumRange(offset, size, blocksize int64) ([]uint64, error) {
+	var hashes []uint64
+	err := lsf.conn.ChecksumRange(ChecksumRangeArgs{
+		Handle:    lsf.handle,
+		BlockSize: blocksize,
+		Offset:    offset,
+		Size:      size,
+	}, &hashes)
+	if err == nil {
+		p.Add(ReadBytes, uint64(size))
+	}
+	return hashes, err
+}
+
+func (lsf *localSourceFile) Delta(args DeltaArgs) (DeltaResponse, error) {
+	var response DeltaResponse
+	args.Handle = lsf.handle
+	err := lsf.conn.Delta(args, &response)
+	if err == nil {
+		p.Add(ReadBytes, uint64(response.End-args.Offset))
+	}
+	return response, err
+}
+
+// Extents returns where the data is in the file
+func (lsf *localSourceFile) Extents() ([]Extent, error) {
+	var extents []Extent
+	err := lsf.conn.Extents(lsf.handle, &extents)
+	return extents, err
+}
+
+// Stream reads ahead of the writer
+func (lsf *localSourceFile) Stream(chunks []GetChunkArgs, window int) *ChunkStream {
+	cs := newChunkStream(window)
+	go func() {
+		defer close(cs.chunks)
+		for _, args := range chunks {
+			data, err := lsf.getChunk(args)
+			if !cs.deliver(StreamChunk{
+				Offset: int64(args.Offset),
+				Data:   data,
+				Err:    err,
+			}) || err != nil {
+				return
+			}
+		}
+	}()
+	return cs
+}
+
+func (lsf *localSourceFile) Close() error {
+	return lsf.conn.Close(lsf.handle, nil)
+}
@@ -0,0 +1,100 @@
+package main
+
+import "bytes"
+
+// Extent is a range of a file that has data, everything between extents is
+// a hole that reads as zeros without taking up space
+type Extent struct {
+	Offset, Size int64
+}
+
+// Extents returns where the data is in an open file
+func (c *Connection) Extents(handle uint64, reply *[]Extent) error {
+	fh, err := c.handle(handle)
+	if err != nil {
+		return err
+	}
+	logger.Trace().Msgf("Finding data extents in file %s", fh.name)
+	info, err := fh.fh.Stat()
+	if err != nil {
+		return err
+	}
+	extents, err := dataExtents(fh.fh, info.Size())
+	*reply = extents
+	return err
+}
+
+type PunchHoleArgs struct {
+	Handle       uint64
+	Offset, Size int64
+}
+
+// PunchHole turns a range of an open file into a hole
+func (c *Connection) PunchHole(args PunchHoleArgs, reply *interface{}) error {
+	if c.ReadOnly {
+		return ErrReadOnly
+	}
+	fh, err := c.handle(args.Handle)
+	if err != nil {
+		return err
+	}
+	logger.Trace().Msgf("Punching hole in file %s at offset %d size %d", fh.name, args.Offset, args.Size)
+	return punchHole(fh.fh, args.Offset, args.Size)
+}
+
+// extentsIn returns the parts of the extents in [start, end)
+func extentsIn(extents []Extent, start, end int64) []Extent {
+	var result []Extent
+	for _, extent := range extents {
+		from, to := max(start, extent.Offset), min(end, extent.Offset+extent.Size)
+		if from < to {
+			result = append(result, Extent{Offset: from, Size: to - from})
+		}
+	}
+	return result
+}
+
+// addExtent appends extent, merging it with the last one if they touch
+func addExtent(extents []Extent, extent Extent) []Extent {
+	if n := len(extents); n > 0 && extents[n-1].Offset+extents[n-1].Size == extent.Offset {
+		extents[n-1].Size += extent.Size
+		return extents
+	}
+	return append(extents, extent)
+}
+
+// holes returns the ranges between the extents in [start, end)
+func holes(extents []Extent, start, end int64) []Extent {
+	if start >= end {
+		return nil
+	}
+	var result []Extent
+	at := start
+	for _, extent := range extents {
+		if extent.Offset > at {
+			result = append(result, Extent{Offset: at, Size: min(extent.Offset, end) - at})
+		}
+		at = max(at, extent.Offset+extent.Size)
+		if at >= end {
+			return result
+		}
+	}
+	if at < end {
+		result = append(result, Extent{Offset: at, Size: end - at})
+	}
+	return result
+}
+
+var zeroBlock = make([]byte, 64*1024)
+
+// isZero is true if data is all zeros, so it can be left as a hole
+func isZero(data []byte) bool {
+	for len(data) > 0 {
+		n := min(len(data), len(zeroBlock))
+		if !bytes.Equal(data[:n], zeroBlock[:n]) {
+			return false
+		}
+		data = data[n:]
+	}
+	return true
+}
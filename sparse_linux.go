@@ -0,0 +1,45 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"os"
+
+	unix "golang.org/x/sys/unix"
+)
+
+// dataExtents finds the parts of a file that have data using SEEK_DATA and
+// SEEK_HOLE, on filesystems without support the whole file is data
+func dataExtents(f *os.File, size int64) ([]Extent, error) {
+	fd := int(f.Fd())
+	var extents []Extent
+	for offset := int64(0); offset < size; {
+		data, err := unix.Seek(fd, offset, unix.SEEK_DATA)
+		if err == unix.ENXIO {
+			// nothing but a hole until the end
+			break
+		}
+		if err == unix.EINVAL || err == unix.EOPNOTSUPP {
+			return []Extent{{Offset: 0, Size: size}}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		hole, err := unix.Seek(fd, data, unix.SEEK_HOLE)
+		if err != nil {
+			return nil, err
+		}
+		hole = min(hole, size)
+		if hole > data {
+			extents = append(extents, Extent{Offset: data, Size: hole - data})
+		}
+		offset = hole
+	}
+	return extents, nil
+}
+
+// punchHole deallocates a range of a file without changing its size
+func punchHole(f *os.File, offset, size int64) error {
+	return unix.Fallocate(int(f.Fd()), unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, offset, size)
+}
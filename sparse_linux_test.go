@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"syscall"
+	"testing"
+)
+
+func TestExtentRanges(t *testing.T) {
+	extents := []Extent{{Offset: 10, Size: 10}, {Offset: 40, Size: 20}}
+	for _, test := range []struct {
+		start, end    int64
+		data, between []Extent
+	}{
+		{0, 100, extents, []Extent{{0, 10}, {20, 20}, {60, 40}}},
+		{15, 45, []Extent{{15, 5}, {40, 5}}, []Extent{{20, 20}}},
+		{20, 40, nil, []Extent{{20, 20}}},
+		{40, 60, []Extent{{40, 20}}, nil},
+		{50, 50, nil, nil},
+	} {
+		if got := extentsIn(extents, test.start, test.end); !slices.Equal(got, test.data) {
+			t.Errorf("extentsIn %v to %v is %v, expected %v", test.start, test.end, got, test.data)
+		}
+		if got := holes(extents, test.start, test.end); !slices.Equal(got, test.between) {
+			t.Errorf("holes %v to %v is %v, expected %v", test.start, test.end, got, test.between)
+		}
+	}
+
+	var merged []Extent
+	for _, extent := range []Extent{{0, 10}, {10, 5}, {20, 5}, {25, 5}} {
+		merged = addExtent(merged, extent)
+	}
+	if expected := []Extent{{0, 15}, {20, 10}}; !slices.Equal(merged, expected) {
+		t.Errorf("addExtent gave %v, expected %v", merged, expected)
+	}
+}
+
+// allocated returns how many bytes of a file take up space
+func allocated(t *testing.T, path string) int64 {
+	t.Helper()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Sys().(*syscall.Stat_t).Blocks * 512
+}
+
+func TestChecksumKeepsHoles(t *testing.T) {
+	const blocksize = 128 * 1024
+	for _, inplace := range []bool{false, true} {
+		source, target := t.TempDir(), t.TempDir()
+		sourcefile, targetfile := filepath.Join(source, "sparse"), filepath.Join(target, "sparse")
+
+		// data in every fourth block, with a hole at the end
+		data := make([]byte, blocksize)
+		f, err := os.Create(sourcefile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := int64(0); i < 64; i += 4 {
+			rand.Read(data)
+			f.WriteAt(data, i*blocksize)
+		}
+		f.Truncate(66 * blocksize)
+		f.Close()
+		if allocated(t, sourcefile) > 20*blocksize {
+			t.Skip("the filesystem for temporary files doesn't do holes")
+		}
+
+		// the target is the same size, but with data everywhere
+		garbage := make([]byte, 66*blocksize)
+		rand.Read(garbage)
+		if err := os.WriteFile(targetfile, garbage, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		c := NewClient()
+		c.ParallelFile, c.ParallelDir = 2, 2
+		c.BlockSize = blocksize
+		c.AlwaysChecksum = true
+		c.Sparse = true
+		c.InPlace = inplace
+		if err := c.Run(NewLocalSource(source), NewLocalTarget(target)); err != nil {
+			t.Fatal(err)
+		}
+
+		wanted, _ := os.ReadFile(sourcefile)
+		got, _ := os.ReadFile(targetfile)
+		if !bytes.Equal(got, wanted) {
+			t.Errorf("in place %v: target differs from the source", inplace)
+		}
+		if size := allocated(t, targetfile); size > 20*blocksize {
+			t.Errorf("in place %v: target has %v bytes allocated, expected the holes to be kept", inplace, size)
+		}
+	}
+}
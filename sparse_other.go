@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"os"
+)
+
+// dataExtents can't find holes on this platform, so the whole file is data
+func dataExtents(f *os.File, size int64) ([]Extent, error) {
+	if size == 0 {
+		return nil, nil
+	}
+	return []Extent{{Offset: 0, Size: size}}, nil
+}
+
+func punchHole(f *os.File, offset, size int64) error {
+	return ErrNotSupportedByPlatform
+}
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Target is the side of a sync that files are written to. All paths are
+// relative to the root of the sync.
+type Target interface {
+	Stat(path string) (FileInfo, error)
+	ReadDir(path string) ([]DirEntry, error)
+	Mkdir(path string) error
+	Create(path string, fi FileInfo) error
+	Link(oldpath, newpath string) error
+	Truncate(path string, size int64) error
+	Remove(path string) error
+	RemoveAll(path string) error
+	OpenFile(path string, mode fs.FileMode) (TargetFile, error)
+	// OpenRead opens an existing file only for comparing with, so it works
+	// on files and servers that can't be written to
+	OpenRead(path string) (TargetFile, error)
+	ApplyChanges(path string, current, wanted FileInfo, o CompareOptions) error
+	CreateTemp(path string) (string, error)
+	Rename(oldpath, newpath string) error
+	// Hash returns the strong hash of a whole file for verification
+	Hash(path, algorithm string) (string, error)
+	// LookupID finds the id of a user or group name on the target
+	LookupID(name string, group bool) (uint32, error)
+}
+
+// TargetFile is an existing file on the target opened for updating
+type TargetFile interface {
+	Size() int64
+	// ChecksumRange hashes the blocks in [offset, offset+size)
+	ChecksumRange(offset, size, blocksize int64) ([]uint64, error)
+	WriteAt(data []byte, offset int64) (int, error)
+	// CopyChunk copies a block from another file opened from the same target
+	CopyChunk(src TargetFile, srcoffset, offset, size int64) error
+	Signature(blocksize int64) (Signature, error)
+	// PunchHole deallocates a range, which then reads as zeros
+	PunchHole(offset, size int64) error
+	Sync() error
+	Close() error
+}
+
+// createTempSibling creates an empty hidden file next to the given path to
+// build a replacement for it in, and returns the name of it
+func createTempSibling(absolutepath string) (string, error) {
+	base := filepath.Base(absolutepath)
+	if len(base) > 200 {
+		// leave room for the random part and suffix
+		base = base[:200]
+	}
+	f, err := os.CreateTemp(filepath.Dir(absolutepath), "."+base+".*.fastsync")
+	if err != nil {
+		return "", err
+	}
+	f.Close()
+	return filepath.Base(f.Name()), nil
+}
+
+// isTempSibling is true for names made by createTempSibling
+func isTempSibling(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.HasSuffix(name, ".fastsync")
+}
+
+// LocalTarget writes to the local filesystem (pull mode)
+type LocalTarget struct {
+	BasePath string
+	Options  CompareOptions // inode flags and fake super on this side
+}
+
+func NewLocalTarget(basepath string) *LocalTarget {
+	return &LocalTarget{
+		BasePath: basepath,
+	}
+}
+
+func (lt *LocalTarget) abs(path string) string {
+	return filepath.Join(lt.BasePath, path)
+}
+
+func (lt *LocalTarget) Stat(path string) (FileInfo, error) {
+	return PathToFileInfo(lt.abs(path), lt.Options)
+}
+
+func (lt *LocalTarget) ReadDir(path string) ([]DirEntry, error) {
+	entries, err := os.ReadDir(lt.abs(path))
+	if err != nil {
+		return nil, err
+	}
+	result := make([]DirEntry, len(entries))
+	for i, entry := range entries {
+		result[i] = DirEntry{
+			Name:  entry.Name(),
+			IsDir: entry.IsDir(),
+		}
+	}
+	return result, nil
+}
+
+func (lt *LocalTarget) Mkdir(path string) error {
+	return os.MkdirAll(lt.abs(path), 0755)
+}
+
+func (lt *LocalTarget) Create(path string, fi FileInfo) error {
+	return FileInfo{Name: lt.abs(path)}.Create(fi, lt.Options)
+}
+
+func (lt *LocalTarget) Link(oldpath, newpath string) error {
+	return os.Link(lt.abs(oldpath), lt.abs(newpath))
+}
+
+func (lt *LocalTarget) Truncate(path string, size int64) error {
+	return os.Truncate(lt.abs(path), size)
+}
+
+func (lt *LocalTarget) Remove(path string) error {
+	return os.Remove(lt.abs(path))
+}
+
+func (lt *LocalTarget) RemoveAll(path string) error {
+	return os.RemoveAll(lt.abs(path))
+}
+
+func (lt *LocalTarget) OpenFile(path string, mode fs.FileMode) (TargetFile, error) {
+	return lt.open(path, os.O_RDWR, mode)
+}
+
+func (lt *LocalTarget) OpenRead(path string) (TargetFile, error) {
+	return lt.open(path, os.O_RDONLY, 0)
+}
+
+func (lt *LocalTarget) open(path string, flag int, mode fs.FileMode) (TargetFile, error) {
+	f, err := os.OpenFile(lt.abs(path), flag, mode)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &localTargetFile{
+		f:    f,
+		size: info.Size(),
+	}, nil
+}
+
+func (lt *LocalTarget) ApplyChanges(path string, current, wanted FileInfo, o CompareOptions) error {
+	current.Name = lt.abs(path)
+	// like the server, we only know the flags if we read them
+	o.InodeFlags = o.InodeFlags && lt.Options.InodeFlags
+	o.FakeSuper = lt.Options.FakeSuper
+	return current.ApplyChanges(wanted, o)
+}
+
+func (lt *LocalTarget) CreateTemp(path string) (string, error) {
+	name, err := createTempSibling(lt.abs(path))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(filepath.Dir(path), name), nil
+}
+
+func (lt *LocalTarget) Rename(oldpath, newpath string) error {
+	return os.Rename(lt.abs(oldpath), lt.abs(newpath))
+}
+
+func (lt *LocalTarget) Hash(path, algorithm string) (string, error) {
+	return hashFile(lt.abs(path), algorithm)
+}
+
+func (lt *LocalTarget) LookupID(name string, group bool) (uint32, error) {
+	return lookupID(name, group)
+}
+
+type localTargetFile struct {
+	f    *os.File
+	size int64
+}
+
+func (ltf *localTargetFile) Size() int64 {
+	return ltf.size
+}
+
+func (ltf *localTargetFile) ChecksumRange(offset, size, blocksize int64) ([]uint64, error) {
+	hashes, err := ChecksumBlocks(ltf.f, offset, size, blocksize)
+	if err == nil {
+		p.Add(ReadBytes, uint64(size))
+	}
+	return hashes, err
+}
+
+func (ltf *localTargetFile) WriteAt(data []byte, offset int64) (int, error) {
+	n, err := ltf.f.WriteAt(data, offset)
+	p.Add(WrittenBytes, uint64(n))
+	return n, err
+}
+
+func (ltf *localTargetFile) CopyChunk(src TargetFile, srcoffset, offset, size int64) error {
+	srcfile, ok := src.(*localTargetFile)
+	if !ok {
+		return ErrTypeError
+	}
+	data := make([]byte, size)
+	_, err := srcfile.f.ReadAt(data, srcoffset)
+	if err != nil {
+		return err
+	}
+	p.Add(ReadBytes, uint64(size))
+	_, err = ltf.WriteAt(data, offset)
+	return err
+}
+
+func (ltf *localTargetFile) Signature(blocksize int64) (Signature, error) {
+	sig, err := ComputeSignature(ltf.f, ltf.size, blocksize)
+	if err == nil {
+		p.Add(ReadBytes, uint64(ltf.size))
+	}
+	return sig, err
+}
+
+func (ltf *localTargetFile) PunchHole(offset, size int64) error {
+	return punchHole(ltf.f, offset, size)
+}
+
+func (ltf *localTargetFile) Sync() error {
+	return ltf.f.Sync()
+}
+
+func (ltf *localTargetFile) Close() error {
+	return ltf.f.Close()
+}
+
+// RemoteTarget writes to a fastsync server started with --writable (push mode)
+type RemoteTarget struct {
+	pool  *ConnectionPool
+	temps sync.Map // temporary file => the file it replaces
+}
+
+func NewRemoteTarget(pool *ConnectionPool) *RemoteTarget {
+	return &RemoteTarget{
+		pool: pool,
+	}
+}
+
+// client returns the connection for path, where temporary files use the same
+// one as the file they replace, so blocks can be copied between them
+func (rt *RemoteTarget) client(path string) *RPCClient {
+	if original, found := rt.temps.Load(path); found {
+		return rt.pool.For(original.(string))
+	}
+	return rt.pool.For(path)
+}
+
+func (rt *RemoteTarget) Stat(path string) (FileInfo, error) {
+	var fi FileInfo
+	err := rt.client(path).Call("Server.Stat", path, &fi)
+	return fi, rpcError(err, path)
+}
+
+func (rt *RemoteTarget) ReadDir(path string) ([]DirEntry, error) {
+	var entries []DirEntry
+	err := rt.client(path).Call("Server.ReadDir", path, &entries)
+	return entries, rpcError(err, path)
+}
+
+func (rt *RemoteTarget) Mkdir(path string) error {
+	return rpcError(rt.client(path).Call("Server.Mkdir", path, nil), path)
+}
+
+func (rt *RemoteTarget) Create(path string, fi FileInfo) error {
+	return rpcError(rt.client(path).Call("Server.Create", FileInfoArgs{Path: path, Info: fi}, nil), path)
+}
+
+func (rt *RemoteTarget) Link(oldpath, newpath string) error {
+	return rpcError(rt.client(newpath).Call("Server.Link", LinkArgs{OldPath: oldpath, NewPath: newpath}, nil), newpath)
+}
+
+func (rt *RemoteTarget) Truncate(path string, size int64) error {
+	return rpcError(rt.client(path).Call("Server.Truncate", TruncateArgs{Path: path, Size: size}, nil), path)
+}
+
+func (rt *RemoteTarget) Remove(path string) error {
+	err := rt.client(path).Call("Server.Delete", DeleteArgs{Path: path}, nil)
+	rt.temps.Delete(path)
+	return rpcError(err, path)
+}
+
+func (rt *RemoteTarget) RemoveAll(path string) error {
+	return rpcError(rt.client(path).Call("Server.Delete", DeleteArgs{Path: path, Recursive: true}, nil), path)
+}
+
+func (rt *RemoteTarget) OpenFile(path string, mode fs.FileMode) (TargetFile, error) {
+	return rt.open(path, "Server.OpenWrite")
+}
+
+func (rt *RemoteTarget) OpenRead(path string) (TargetFile, error) {
+	return rt.open(path, "Server.Open")
+}
+
+func (rt *RemoteTarget) open(path, openmethod string) (TargetFile, error) {
+	rh, err := openRemoteHandle(rt.client(path), openmethod, path)
+	if err != nil {
+		return nil, err
+	}
+	return &remoteTargetFile{
+		remoteHandle: rh,
+	}, nil
+}
+
+func (rt *RemoteTarget) ApplyChanges(path string, current, wanted FileInfo, o CompareOptions) error {
+	return rpcError(rt.client(path).Call("Server.ApplyChanges", FileInfoArgs{Path: path, Info: wanted, Options: o}, nil), path)
+}
+
+func (rt *RemoteTarget) CreateTemp(path string) (string, error) {
+	var temppath string
+	err := rt.client(path).Call("Server.CreateTemp", path, &temppath)
+	if err != nil {
+		return "", rpcError(err, path)
+	}
+	rt.temps.Store(temppath, path)
+	return temppath, nil
+}
+
+func (rt *RemoteTarget) Rename(oldpath, newpath string) error {
+	err := rt.client(oldpath).Call("Server.Rename", RenameArgs{OldPath: oldpath, NewPath: newpath}, nil)
+	rt.temps.Delete(oldpath)
+	return rpcError(err, newpath)
+}
+
+func (rt *RemoteTarget) Hash(path, algorithm string) (string, error) {
+	return hashRemote(rt.client(path), path, algorithm)
+}
+
+func (rt *RemoteTarget) LookupID(name string, group bool) (uint32, error) {
+	var id uint32
+	err := rt.pool.For(name).Call("Server.LookupID", LookupIDArgs{Name: name, Group: group}, &id)
+	return id, err
+}
+
+// remoteTargetFile is a file opened on the server. Writes go to fixed
+// offsets, so they can all be sent again after reconnecting.
+type remoteTargetFile struct {
+	*remoteHandle
+}
+
+func (rtf *remoteTargetFile) Size() int64 {
+	return rtf.size
+}
+
+func (rtf *remoteTargetFile) ChecksumRange(offset, size, blocksize int64) ([]uint64, error) {
+	var hashes []uint64
+	err := rtf.call("Server.ChecksumRange", func() (any, error) {
+		handle, _, err := rtf.current()
+		return ChecksumRangeArgs{
+			Handle:    handle,
+			BlockSize: blocksize,
+			Offset:    offset,
+			Size:      size,
+		}, err
+	}, &hashes)
+	return hashes, err
+}
+
+func (rtf *remoteTargetFile) WriteAt(data []byte, offset int64) (int, error) {
+	err := rtf.call("Server.WriteChunk", func() (any, error) {
+		handle, _, err := rtf.current()
+		return WriteChunkArgs{
+			Handle: handle,
+			Offset: uint64(offset),
+			Data:   data,
+		}, err
+	}, nil)
+	if err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// CopyChunk is done entirely on the server, so unchanged data doesn't cross the wire
+func (rtf *remoteTargetFile) CopyChunk(src TargetFile, srcoffset, offset, size int64) error {
+	srcfile, ok := src.(*remoteTargetFile)
+	if !ok || srcfile.client != rtf.client {
+		return ErrTypeError
+	}
+	return rtf.call("Server.CopyChunk", func() (any, error) {
+		from, _, err := srcfile.current()
+		if err != nil {
+			return nil, err
+		}
+		to, _, err := rtf.current()
+		return CopyChunkArgs{
+			From:       from,
+			To:         to,
+			FromOffset: uint64(srcoffset),
+			Offset:     uint64(offset),
+			Size:       uint64(size),
+		}, err
+	}, nil)
+}
+
+// Signature asks for a limited number of blocks at a time, so no call takes
+// long enough to look like a dead connection
+func (rtf *remoteTargetFile) Signature(blocksize int64) (Signature, error) {
+	sig := Signature{
+		Size:      rtf.size,
+		BlockSize: blocksize,
+	}
+	batchsize := blocksize * checksumBlocksPerRequest
+	for offset := int64(0); offset < rtf.size; offset += batchsize {
+		var part Signature
+		err := rtf.call("Server.Signature", func() (any, error) {
+			handle, _, err := rtf.current()
+			return SignatureArgs{
+				Handle:    handle,
+				BlockSize: blocksize,
+				Offset:    offset,
+				Size:      min(batchsize, rtf.size-offset),
+			}, err
+		}, &part)
+		if err != nil {
+			return sig, err
+		}
+		sig.Blocks = append(sig.Blocks, part.Blocks...)
+	}
+	return sig, nil
+}
+
+func (rtf *remoteTargetFile) PunchHole(offset, size int64) error {
+	return rtf.call("Server.PunchHole", func() (any, error) {
+		handle, _, err := rtf.current()
+		return PunchHoleArgs{
+			Handle: handle,
+			Offset: offset,
+			Size:   size,
+		}, err
+	}, nil)
+}
+
+func (rtf *remoteTargetFile) Sync() error {
+	return rtf.call("Server.Sync", func() (any, error) {
+		handle, _, err := rtf.current()
+		return handle, err
+	}, nil)
+}
+
+func (rtf *remoteTargetFile) Close() error {
+	return rtf.close()
+}
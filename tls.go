@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"time"
+)
+
+// ServerTLSConfig returns the TLS configuration for the server. If a CA file
+// is given clients must present a certificate signed by it.
+func ServerTLSConfig(certfile, keyfile, cafile string) (*tls.Config, error) {
+	if certfile == "" || keyfile == "" {
+		return nil, errors.New("server needs both --tls-cert and --tls-key for TLS")
+	}
+	cert, err := tls.LoadX509KeyPair(certfile, keyfile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if cafile != "" {
+		pool, err := loadCertPool(cafile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// ClientTLSConfig returns the TLS configuration for the client. The server is
+// verified against the CA file if given (otherwise the system roots), and the
+// client certificate is presented if given.
+func ClientTLSConfig(certfile, keyfile, cafile, servername string) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName: servername,
+		MinVersion: tls.VersionTLS12,
+	}
+	if certfile != "" || keyfile != "" {
+		cert, err := tls.LoadX509KeyPair(certfile, keyfile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if cafile != "" {
+		pool, err := loadCertPool(cafile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
+
+func loadCertPool(cafile string) (*x509.CertPool, error) {
+	pemdata, err := os.ReadFile(cafile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pemdata) {
+		return nil, errors.New("no certificates found in " + cafile)
+	}
+	return pool, nil
+}
+
+// GenerateSelfSignedCert writes a self signed certificate and key that can be
+// used as server certificate, client certificate and CA at the same time, so
+// copying the two files to both sides is enough for a quick setup
+func GenerateSelfSignedCert(certfile, keyfile string, hosts []string, validity time.Duration) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "fastsync"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(validity),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyder, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(certfile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(keyfile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyder}), 0600)
+}
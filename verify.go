@@ -0,0 +1,338 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/zeebo/blake3"
+	"github.com/zeebo/xxh3"
+)
+
+// verifyHashes are the strong whole-file hashes used to prove that a copy is
+// bit-exact, unlike the 64-bit block checksums which only detect changes
+var verifyHashes = map[string]func() hash.Hash{
+	"sha256":   sha256.New,
+	"blake3":   func() hash.Hash { return blake3.New() },
+	"xxh3-128": func() hash.Hash { return xxh3128{xxh3.New()} },
+}
+
+// xxh3128 is the xxh3 hasher giving its 128-bit sum
+type xxh3128 struct {
+	*xxh3.Hasher
+}
+
+func (h xxh3128) Size() int { return 16 }
+
+func (h xxh3128) Sum(b []byte) []byte {
+	sum := h.Sum128().Bytes()
+	return append(b, sum[:]...)
+}
+
+var ErrVerifyMismatch = errors.New("strong hash differs between source and target")
+
+// ParseVerifyHash checks that we know the hash called name
+func ParseVerifyHash(name string) (string, error) {
+	name = strings.ToLower(name)
+	if _, found := verifyHashes[name]; found {
+		return name, nil
+	}
+	return name, fmt.Errorf("unknown verify hash %v, use %v", name, strings.Join(VerifyHashNames(), " or "))
+}
+
+func VerifyHashNames() []string {
+	var names []string
+	for name := range verifyHashes {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// HashReader returns the hex encoded hash of everything in r
+func HashReader(r io.Reader, algorithm string) (string, error) {
+	newhash, found := verifyHashes[algorithm]
+	if !found {
+		return "", fmt.Errorf("unknown verify hash %v", algorithm)
+	}
+	h := newhash()
+	_, err := io.Copy(h, r)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func hashFile(absolutepath string, algorithm string) (string, error) {
+	f, err := os.Open(absolutepath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return HashReader(f, algorithm)
+}
+
+// hashPath returns the strong hash of a whole file below the base
+func (s *Server) hashPath(path, algorithm string) (string, error) {
+	logger.Trace().Msgf("Hashing file %s with %v", path, algorithm)
+	f, times, err := s.openRead(path)
+	if err != nil {
+		return "", err
+	}
+	defer closeRead(f, times)
+	return HashReader(f, algorithm)
+}
+
+// how much of a file is hashed in one call, so no call takes long enough to
+// look like a dead connection
+var hashBytesPerRequest int64 = 64 * 1024 * 1024
+
+type HashRangeArgs struct {
+	Handle    uint64
+	Algorithm string
+	Offset    int64 // zero starts a new hash, otherwise where the last call ended
+	Size      int64
+}
+
+type HashRangeReply struct {
+	Sum string // set when the end of the file was reached
+}
+
+// HashRange adds the next part of an open file to its strong hash, which is
+// kept with the file between calls
+func (c *Connection) HashRange(args HashRangeArgs, reply *HashRangeReply) error {
+	fh, err := c.handle(args.Handle)
+	if err != nil {
+		return err
+	}
+	logger.Trace().Msgf("Hashing file %s with %v at offset %d size %d", fh.name, args.Algorithm, args.Offset, args.Size)
+	if args.Offset == 0 {
+		newhash, found := verifyHashes[args.Algorithm]
+		if !found {
+			return fmt.Errorf("unknown verify hash %v", args.Algorithm)
+		}
+		fh.hash, fh.hashed = newhash(), 0
+	} else if fh.hash == nil || fh.hashed != args.Offset {
+		return errors.New("hash has to continue where the last part ended")
+	}
+	n, err := io.Copy(fh.hash, io.NewSectionReader(fh.fh, args.Offset, args.Size))
+	if err != nil {
+		return err
+	}
+	fh.hashed += n
+	c.handles.AtomicMutate(filehandle{
+		id: args.Handle,
+	}, func(stored *filehandle) {
+		stored.hash, stored.hashed = fh.hash, fh.hashed
+	}, false)
+	if n < args.Size {
+		reply.Sum = hex.EncodeToString(fh.hash.Sum(nil))
+	}
+	return nil
+}
+
+// hashRemote hashes a file on the server in parts. The hash can't be carried
+// over to a new connection, so it starts over if the connection breaks.
+func hashRemote(client *RPCClient, path, algorithm string) (string, error) {
+	rh, err := openRemoteHandle(client, "Server.Open", path)
+	if err != nil {
+		return "", err
+	}
+	defer rh.close()
+	_, generation, err := rh.current()
+	if err != nil {
+		return "", err
+	}
+	var offset int64
+	for {
+		var reply HashRangeReply
+		err = rh.call("Server.HashRange", func() (any, error) {
+			handle, current, err := rh.current()
+			if current != generation {
+				offset, generation = 0, current
+			}
+			return HashRangeArgs{
+				Handle:    handle,
+				Algorithm: algorithm,
+				Offset:    offset,
+				Size:      hashBytesPerRequest,
+			}, err
+		}, &reply)
+		if err != nil {
+			return "", err
+		}
+		if reply.Sum != "" {
+			return reply.Sum, nil
+		}
+		offset += hashBytesPerRequest
+	}
+}
+
+// verifyFile hashes a file on both sides at the same time, and returns the
+// hash if they match
+func (c *Client) verifyFile(sourcepath, targetpath string) (string, error) {
+	var sourcesum string
+	var sourceerr error
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		sourcesum, sourceerr = c.source.Hash(sourcepath, c.VerifyHash)
+		wg.Done()
+	}()
+	targetsum, err := c.target.Hash(targetpath, c.VerifyHash)
+	wg.Wait()
+	if sourceerr != nil {
+		return "", fmt.Errorf("hashing source: %w", sourceerr)
+	}
+	if err != nil {
+		return "", fmt.Errorf("hashing target: %w", err)
+	}
+	if sourcesum != targetsum {
+		logger.Debug().Msgf("File %s has %v %v on the source and %v on the target", sourcepath, c.VerifyHash, sourcesum, targetsum)
+		return "", ErrVerifyMismatch
+	}
+	return c.VerifyHash + ":" + sourcesum, nil
+}
+
+// Verify walks both trees and compares the strong hash of every file, without
+// transferring or changing anything. It returns the number of files checked
+// and how many entries differ.
+func (c *Client) Verify(source Source, target Target) (files, differences int64, err error) {
+	c.source = source
+	c.target = target
+
+	rootinfo, err := source.Stat("/")
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var checked, differ atomic.Int64
+
+	// the same bounded workers as Run, directories on a stack and entries
+	// in a queue
+	dirstack, dirqueueout, dirqueuein := NewStack[string](c.ParallelDir*2, 8)
+	entryqueue := make(chan FileInfo, c.ParallelFile*16)
+	var listing, dirworkers, entryworkers sync.WaitGroup
+
+	report := func(path string, what string, err error) {
+		differ.Add(1)
+		logger.Error().Msgf("%s %v", path, what)
+		if err == nil {
+			err = errors.New(what)
+		}
+		c.ChangeLog.Record(ChangeEntry{
+			Path:   path,
+			Action: ChangeError,
+			Error:  err.Error(),
+		})
+	}
+
+	verifyentry := func(sourcefi FileInfo) {
+		targetfi, err := target.Stat(sourcefi.Name)
+		if err != nil {
+			if os.IsNotExist(err) {
+				report(sourcefi.Name, "is missing on the target", nil)
+			} else {
+				report(sourcefi.Name, "can't be checked on the target", err)
+			}
+			return
+		}
+		diff := targetfi.Compare(sourcefi, c.CompareOptions)
+		switch {
+		case diff.RequiresDelete():
+			report(sourcefi.Name, "is a different kind of entry on the target", nil)
+			return
+		case diff.Size:
+			report(sourcefi.Name, fmt.Sprintf("is %v bytes on the source and %v on the target", sourcefi.Size, targetfi.Size), nil)
+			return
+		case !sourcefi.Mode.IsRegular():
+			return
+		}
+		sum, err := c.verifyFile(sourcefi.Name, sourcefi.Name)
+		if err == ErrVerifyMismatch {
+			report(sourcefi.Name, "has different content on the target", err)
+			return
+		} else if err != nil {
+			report(sourcefi.Name, "can't be hashed", err)
+			return
+		}
+		checked.Add(1)
+		c.ChangeLog.Record(ChangeEntry{
+			Path:   sourcefi.Name,
+			Action: ChangeVerified,
+			Hash:   sum,
+		})
+	}
+
+	verifydir := func(path string) {
+		sourcefiles, err := source.List(path)
+		if err != nil {
+			report(path, "can't be listed on the source", err)
+			return
+		}
+		targetentries, err := target.ReadDir(path)
+		if err != nil && !os.IsNotExist(err) {
+			report(path, "can't be listed on the target", err)
+		}
+
+		sourcenames := map[string]struct{}{}
+		for _, sourcefi := range sourcefiles {
+			if c.Filter.Excluded(sourcefi.Name, sourcefi.IsDir) {
+				continue
+			}
+			sourcenames[sourcefi.Name] = struct{}{}
+			entryqueue <- sourcefi
+			if sourcefi.IsDir {
+				listing.Add(1)
+				dirqueuein <- sourcefi.Name
+			}
+		}
+		for _, te := range targetentries {
+			if isTempSibling(te.Name) {
+				continue
+			}
+			name := filepath.Join(path, te.Name)
+			if _, found := sourcenames[name]; !found && !c.Filter.Excluded(name, te.IsDir) {
+				report(name, "only exists on the target", nil)
+			}
+		}
+	}
+
+	for i := 0; i < c.ParallelDir; i++ {
+		dirworkers.Add(1)
+		go func() {
+			for path := range dirqueueout {
+				verifydir(path)
+				listing.Done()
+			}
+			dirworkers.Done()
+		}()
+	}
+	for i := 0; i < c.ParallelFile; i++ {
+		entryworkers.Add(1)
+		go func() {
+			for sourcefi := range entryqueue {
+				verifyentry(sourcefi)
+			}
+			entryworkers.Done()
+		}()
+	}
+
+	listing.Add(1)
+	dirqueuein <- rootinfo.Name
+	listing.Wait()
+	dirstack.Close()
+	dirworkers.Wait()
+	close(entryqueue)
+	entryworkers.Wait()
+	return checked.Load(), differ.Load(), nil
+}
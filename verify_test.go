@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"hash"
+	"net"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ugorji/go/codec"
+)
+
+func TestVerifyHashes(t *testing.T) {
+	// hashes of nothing from the reference implementations
+	for name, empty := range map[string]string{
+		"sha256":   "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+		"blake3":   "af1349b9f5f9a1a6a0404dea36dcc9499bcb25c9adc112b7cc9a93cae41f3262",
+		"xxh3-128": "99aa06d3014798d86001c324468d497f",
+	} {
+		parsed, err := ParseVerifyHash(strings.ToUpper(name))
+		if err != nil {
+			t.Errorf("%v: %v", name, err)
+			continue
+		}
+		sum, err := HashReader(strings.NewReader(""), parsed)
+		if err != nil {
+			t.Errorf("%v: %v", name, err)
+		} else if sum != empty {
+			t.Errorf("%v of nothing is %v, expected %v", name, sum, empty)
+		}
+	}
+	if _, err := ParseVerifyHash("md5"); err == nil {
+		t.Error("md5 was accepted")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	source, target := t.TempDir(), t.TempDir()
+	for _, dir := range []string{source, target} {
+		for i := 0; i < 20; i++ {
+			sub := filepath.Join(dir, "dir", strings.Repeat("d", i))
+			if err := os.MkdirAll(sub, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(sub, "file"), []byte("content"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	os.WriteFile(filepath.Join(target, "dir", "file"), []byte("CONTENT"), 0644)
+	os.WriteFile(filepath.Join(target, "extra"), nil, 0644)
+	os.Remove(filepath.Join(target, "dir", "dd", "file"))
+
+	c := NewClient()
+	c.ParallelFile, c.ParallelDir = 2, 2
+	c.VerifyHash = "blake3"
+	files, differences, err := c.Verify(NewLocalSource(source), NewLocalTarget(target))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files != 18 || differences != 3 {
+		t.Errorf("verified %v files with %v differences, expected 18 and 3", files, differences)
+	}
+}
+
+// pipeClient returns a client talking to a server for dir over in-memory
+// connections, which gives up after retries reconnects
+func pipeClient(t *testing.T, dir string, readonly bool, retries int, timeout time.Duration) *RPCClient {
+	serverobject := NewServer(dir, readonly)
+	client, err := DialRPCClient(func() (rpc.ClientCodec, error) {
+		clientconn, serverconn := net.Pipe()
+		connection := NewConnection(serverobject)
+		server := rpc.NewServer()
+		if err := server.RegisterName("Server", connection); err != nil {
+			return nil, err
+		}
+		go func() {
+			server.ServeCodec(codec.GoRpc.ServerCodec(serverconn, &codec.MsgpackHandle{}))
+			connection.CloseAll()
+		}()
+		return codec.GoRpc.ClientCodec(clientconn, &codec.MsgpackHandle{}), nil
+	}, retries, timeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// slowHash takes a millisecond for every kilobyte
+type slowHash struct {
+	hash.Hash
+}
+
+func (sh slowHash) Write(data []byte) (int, error) {
+	time.Sleep(time.Duration(len(data)/1024) * time.Millisecond)
+	return sh.Hash.Write(data)
+}
+
+func TestHashSlowerThanTimeout(t *testing.T) {
+	verifyHashes["slow"] = func() hash.Hash { return slowHash{sha256.New()} }
+	defer delete(verifyHashes, "slow")
+	defer func(old int64) { hashBytesPerRequest = old }(hashBytesPerRequest)
+
+	dir := t.TempDir()
+	data := bytes.Repeat([]byte("0123456789abcdef"), 64*1024) // a second to hash
+	if err := os.WriteFile(filepath.Join(dir, "file"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	expected, err := HashReader(bytes.NewReader(data), "sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// all of it in one call is taken for a dead connection
+	hashBytesPerRequest = int64(len(data))
+	source := NewRemoteSource(&ConnectionPool{clients: []*RPCClient{pipeClient(t, dir, true, 0, 200*time.Millisecond)}})
+	if _, err := source.Hash("file", "slow"); err == nil {
+		t.Fatal("hashing everything in one call didn't time out, is the hash slow enough?")
+	}
+
+	hashBytesPerRequest = 64 * 1024
+	source = NewRemoteSource(&ConnectionPool{clients: []*RPCClient{pipeClient(t, dir, true, 0, 200*time.Millisecond)}})
+	sum, err := source.Hash("file", "slow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum != expected {
+		t.Errorf("hash in parts is %v, expected %v", sum, expected)
+	}
+}
+
+func TestRemoteSignature(t *testing.T) {
+	dir := t.TempDir()
+	data := bytes.Repeat([]byte("some data "), 1000)
+	if err := os.WriteFile(filepath.Join(dir, "file"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	expected, err := ComputeSignature(bytes.NewReader(data), int64(len(data)), 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	target := NewRemoteTarget(&ConnectionPool{clients: []*RPCClient{pipeClient(t, dir, false, 0, time.Second)}})
+	f, err := target.OpenFile("file", 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	sig, err := f.Signature(7) // several calls with a short last block
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sig.Size != expected.Size || sig.BlockSize != expected.BlockSize || len(sig.Blocks) != len(expected.Blocks) {
+		t.Fatalf("signature of %v bytes in %v blocks of %v, expected %v in %v", sig.Size, len(sig.Blocks), sig.BlockSize, expected.Size, len(expected.Blocks))
+	}
+	for i := range sig.Blocks {
+		if sig.Blocks[i] != expected.Blocks[i] {
+			t.Fatalf("block %v is %+v, expected %+v", i, sig.Blocks[i], expected.Blocks[i])
+		}
+	}
+}